@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/httpclient"
+	"github.com/sensu/sensu-ec2-handler/aws"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-go/types"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	archiveFormatJSON = "json"
+	archiveFormatYAML = "yaml"
+
+	// archiveTimeFormat is the format of the timestamp of the archive names
+	archiveTimeFormat = "20060102T150405Z"
+)
+
+// archiveDestination is where the entity definitions are archived before
+// deleting them: a local directory, a prefix of an S3 bucket, or an HTTP store
+// the definitions are PUT to, such as the web server of the Sensu assets.
+type archiveDestination struct {
+	directory string
+	bucket    string
+	prefix    string
+	url       string
+}
+
+// parseArchiveDestination parses a local directory, an s3://bucket/prefix URL
+// or an http(s) URL.
+func parseArchiveDestination(destination string) (*archiveDestination, error) {
+	switch {
+	case strings.HasPrefix(destination, "s3://"):
+		destinationURL, err := url.Parse(destination)
+		if err != nil {
+			return nil, err
+		}
+		if len(destinationURL.Host) == 0 {
+			return nil, fmt.Errorf("missing s3 bucket name")
+		}
+		return &archiveDestination{bucket: destinationURL.Host, prefix: strings.Trim(destinationURL.Path, "/")}, nil
+	case strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://"):
+		if _, err := url.Parse(destination); err != nil {
+			return nil, err
+		}
+		return &archiveDestination{url: strings.TrimRight(destination, "/")}, nil
+	case strings.HasPrefix(destination, "file://"):
+		return &archiveDestination{directory: strings.TrimPrefix(destination, "file://")}, nil
+	default:
+		return &archiveDestination{directory: destination}, nil
+	}
+}
+
+// archiveEntity writes the definition of the entity to the archive
+// destination, in the format sensuctl create reads. The location of the
+// archive is returned.
+func archiveEntity(ctx context.Context, entity *corev2.Entity) (string, error) {
+	content, contentType, err := marshalArchive(entity)
+	if err != nil {
+		return "", err
+	}
+	name := archiveName(entity, time.Now())
+
+	log.Printf("Archiving entity (%s/%s)", entity.Namespace, entity.Name)
+	switch {
+	case len(archiveTarget.bucket) > 0:
+		key := path.Join(archiveTarget.prefix, name)
+		awsHandler, err := aws.NewHandler(&awsConfig, awsClientFactories)
+		if err != nil {
+			return "", fmt.Errorf("could not initialize handler: %s", err)
+		}
+		if err := awsHandler.PutObjectWithContext(ctx, archiveTarget.bucket, key, content, contentType); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("s3://%s/%s", archiveTarget.bucket, key), nil
+	case len(archiveTarget.url) > 0:
+		location := archiveTarget.url + "/" + name
+		if err := putArchive(ctx, location, content, contentType); err != nil {
+			return "", fmt.Errorf("error uploading %s: %s", location, err)
+		}
+		return location, nil
+	default:
+		location := filepath.Join(archiveTarget.directory, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(location), 0750); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(location, content, 0640); err != nil {
+			return "", err
+		}
+		return location, nil
+	}
+}
+
+// archiveName returns the name of the archive of the entity at the given
+// time, namespace/entity/timestamp.format.
+func archiveName(entity *corev2.Entity, at time.Time) string {
+	return path.Join(entity.Namespace, entity.Name, at.UTC().Format(archiveTimeFormat)+"."+archiveFormat)
+}
+
+// marshalArchive marshals the entity wrapped with its type and API version,
+// returning the content along with its content type.
+func marshalArchive(entity *corev2.Entity) ([]byte, string, error) {
+	wrapper := types.WrapResource(entity)
+	if archiveFormat == archiveFormatYAML {
+		content, err := yaml.Marshal(wrapper)
+		if err != nil {
+			return nil, "", fmt.Errorf("error marshalling entity to yaml: %s", err)
+		}
+		return content, "application/x-yaml", nil
+	}
+	content, err := json.MarshalIndent(wrapper, "", "  ")
+	if err != nil {
+		return nil, "", fmt.Errorf("error marshalling entity to json: %s", err)
+	}
+	return append(content, '\n'), "application/json", nil
+}
+
+// putArchive uploads the archive to the HTTP store, retrying the rate limiting,
+// server and network errors like the Sensu API ones.
+func putArchive(ctx context.Context, location string, content []byte, contentType string) error {
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}
+	return awsConfig.RetryPolicy.Do(ctx, "Uploading archive", isRetryableSensuError, func() error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPut, location, bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", contentType)
+		if len(archiveAuthorization) > 0 {
+			request.Header.Set("Authorization", archiveAuthorization)
+		}
+
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode >= 300 {
+			body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1<<16))
+			return httpclient.HTTPError{StatusCode: response.StatusCode, Body: string(body)}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sensu/sensu-ec2-handler/aws"
+	"github.com/sensu/sensu-ec2-handler/retry"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+const (
+	// auditRecordVersion is the version of the audit record schema, it is
+	// incremented on any incompatible change of the schema
+	auditRecordVersion = 1
+
+	// auditStdout is the audit log destination writing to stdout
+	auditStdout = "stdout"
+
+	auditCommandHandler = "handler"
+
+	// actionKeep and actionNone are the audited actions when the entity is
+	// kept, or when no decision could be taken because of an error
+	actionKeep = "keep"
+	actionNone = "none"
+)
+
+// auditRecord is a single line of the audit log. Its fields are always
+// present, the schema is documented in the README.
+type auditRecord struct {
+	Version        int              `json:"version"`
+	Timestamp      time.Time        `json:"timestamp"`
+	Command        string           `json:"command"`
+	Namespace      string           `json:"namespace"`
+	Entity         string           `json:"entity"`
+	InstanceID     string           `json:"instance_id"`
+	AccountID      string           `json:"account_id"`
+	Region         string           `json:"region"`
+	InstanceState  string           `json:"instance_state"`
+	AllowedStates  []string         `json:"allowed_states"`
+	Instance       *aws.Instance    `json:"instance"`
+	LifecycleState string           `json:"lifecycle_state"`
+	TagRule        string           `json:"tag_rule"`
+	Protected      string           `json:"protected"`
+	Aborted        string           `json:"aborted"`
+	Unchanged      string           `json:"unchanged"`
+	Action         string           `json:"action"`
+	Archive        string           `json:"archive"`
+	Events         []*eventDeletion `json:"events"`
+	DryRun         bool             `json:"dry_run"`
+	Error          string           `json:"error"`
+	Retries        int              `json:"retries"`
+}
+
+// newAuditRecord creates the audit record of the decision taken for the
+// entity. The report is nil when the handler failed before taking a decision.
+func newAuditRecord(command string, retries *retry.Counter, entity *corev2.Entity, instanceID string, report *deregistrationReport, err error) *auditRecord {
+	record := &auditRecord{
+		Version:       auditRecordVersion,
+		Timestamp:     time.Now().UTC(),
+		Command:       command,
+		Namespace:     entity.Namespace,
+		Entity:        entity.Name,
+		InstanceID:    instanceID,
+		AllowedStates: allowedInstanceStates(),
+		Action:        actionNone,
+		Events:        []*eventDeletion{},
+		DryRun:        dryRun,
+		Retries:       retries.Retries(),
+	}
+	if report != nil {
+		record.InstanceID = report.InstanceID
+		record.AccountID = report.AccountID
+		record.Region = report.Region
+		record.InstanceState = report.InstanceState
+		record.Instance = report.Instance
+		record.LifecycleState = report.LifecycleState
+		record.TagRule = report.TagRule
+		record.Protected = report.Protected
+		record.Aborted = report.Aborted
+		record.Unchanged = report.Unchanged
+		record.Archive = report.Archive
+		if report.Events != nil {
+			record.Events = report.Events
+		}
+		record.Action = actionKeep
+		if report.Deregister {
+			record.Action = report.Action
+		}
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// writeAuditRecord writes the record as a single JSON line to every audit log
+// destination.
+func writeAuditRecord(record *auditRecord) error {
+	if len(auditLogDestinations) == 0 {
+		return nil
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("error marshalling audit record to json: %s", err)
+	}
+	recordBytes = append(recordBytes, '\n')
+
+	for _, destination := range auditLogDestinations {
+		if destination == auditStdout {
+			_, err = os.Stdout.Write(recordBytes)
+		} else {
+			err = appendAuditLog(destination, recordBytes, int64(auditLogMaxSize)*1024*1024, auditLogMaxBackups)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing audit record to %s: %s", destination, err)
+		}
+	}
+	return nil
+}
+
+// auditDecision writes the audit record of the decision taken for the entity.
+// A failure to write the record is returned unless the decision itself failed,
+// in which case it is only logged.
+func auditDecision(command string, retries *retry.Counter, entity *corev2.Entity, instanceID string, report *deregistrationReport, err error) error {
+	auditErr := writeAuditRecord(newAuditRecord(command, retries, entity, instanceID, report, err))
+	if auditErr == nil {
+		return err
+	}
+	if err != nil {
+		log.Printf("%s\n", auditErr)
+		return err
+	}
+	return auditErr
+}
+
+// appendAuditLog appends the line to the audit log file, rotating the file
+// first when the line would make it larger than maxSize bytes. A maxSize of
+// zero disables the rotation. The rotation holds the lock of the audit log, as
+// concurrent handler runs would otherwise shift the backups more than once.
+func appendAuditLog(path string, line []byte, maxSize int64, maxBackups int) error {
+	if maxSize <= 0 {
+		return writeAuditLog(path, line)
+	}
+
+	// The lock is waited for even when the run timed out, so that the
+	// decision is still audited
+	ctx, cancel := context.WithTimeout(context.Background(), staleLockAge)
+	defer cancel()
+	return withStateLock(ctx, path, func() error {
+		info, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err == nil && info.Size() > 0 && info.Size()+int64(len(line)) > maxSize {
+			if err := rotateAuditLog(path, maxBackups); err != nil {
+				return fmt.Errorf("error rotating audit log: %s", err)
+			}
+		}
+		return writeAuditLog(path, line)
+	})
+}
+
+// writeAuditLog appends the line to the audit log file.
+func writeAuditLog(path string, line []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rotateAuditLog renames the audit log file to path.1, shifting the existing
+// backups and removing the ones beyond maxBackups.
+func rotateAuditLog(path string, maxBackups int) error {
+	if maxBackups <= 0 {
+		return removeIfExists(path)
+	}
+	if err := removeIfExists(fmt.Sprintf("%s.%d", path, maxBackups)); err != nil {
+		return err
+	}
+	for i := maxBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", path, i), fmt.Sprintf("%s.%d", path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(path, path+".1")
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// parseAuditLogDestinations splits the comma separated audit log destinations.
+func parseAuditLogDestinations(destinations string) []string {
+	parsed := []string{}
+	for _, destination := range strings.Split(destinations, ",") {
+		trimmedDestination := strings.TrimSpace(destination)
+		if len(trimmedDestination) > 0 {
+			parsed = append(parsed, trimmedDestination)
+		}
+	}
+	return parsed
+}
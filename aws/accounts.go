@@ -0,0 +1,86 @@
+package aws
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+var (
+	// assumedRoleCredentials caches the credentials of the assumed roles for
+	// the lifetime of the process, keyed by role ARN
+	assumedRoleCredentials      = make(map[string]*credentials.Credentials)
+	assumedRoleCredentialsMutex sync.Mutex
+)
+
+// roleTemplateData is the data available to the assume role template
+type roleTemplateData struct {
+	AccountID string
+}
+
+// ParseRoleTemplate parses the template used to build the ARN of the role to
+// assume in an account, for example "arn:aws:iam::{{.AccountID}}:role/sensu".
+func ParseRoleTemplate(text string) (*template.Template, error) {
+	roleTemplate, err := template.New("role").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing assume role template: %s", err)
+	}
+	return roleTemplate, nil
+}
+
+// accountRoleArn returns the ARN of the role to assume in the account, read
+// from the accounts map or built from the assume role template. An empty ARN
+// is returned when no role is configured for the account.
+func (awsHandler *Handler) accountRoleArn(accountID string) (string, error) {
+	if roleArn, ok := awsHandler.config.AwsAccountsMap[accountID]; ok {
+		return roleArn, nil
+	}
+	if awsHandler.roleTemplate == nil {
+		return "", nil
+	}
+
+	var roleArn bytes.Buffer
+	if err := awsHandler.roleTemplate.Execute(&roleArn, roleTemplateData{AccountID: accountID}); err != nil {
+		return "", fmt.Errorf("error executing assume role template for account %s: %s", accountID, err)
+	}
+	if !arn.IsARN(roleArn.String()) {
+		return "", fmt.Errorf("assume role template for account %s is not a valid ARN: %s", accountID, roleArn.String())
+	}
+	return roleArn.String(), nil
+}
+
+// accountCredentials returns the credentials used to access the account. The
+// default credentials are returned for an empty account, or an account without
+// a role to assume.
+func (awsHandler *Handler) accountCredentials(accountID string) (*credentials.Credentials, error) {
+	if len(accountID) == 0 {
+		return awsHandler.awsCredentials, nil
+	}
+	roleArn, err := awsHandler.accountRoleArn(accountID)
+	if err != nil {
+		return nil, err
+	}
+	if len(roleArn) == 0 {
+		log.Printf("No role to assume configured for account %s, using the default credentials\n", accountID)
+		return awsHandler.awsCredentials, nil
+	}
+
+	assumedRoleCredentialsMutex.Lock()
+	defer assumedRoleCredentialsMutex.Unlock()
+	if creds, ok := assumedRoleCredentials[roleArn]; ok {
+		return creds, nil
+	}
+
+	// Assume the account role with the default credentials, which may
+	// themselves come from the assumed role ARN
+	log.Printf("Assuming role %s for account %s\n", roleArn, accountID)
+	creds := awsHandler.factories.Credentials(awsHandler.awsSession.Copy(&aws.Config{Credentials: awsHandler.awsCredentials}), roleArn)
+	assumedRoleCredentials[roleArn] = creds
+	return creds, nil
+}
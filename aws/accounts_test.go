@@ -0,0 +1,81 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccountRoleArn(t *testing.T) {
+	assert := assert.New(t)
+	config := &Config{
+		AssumeRoleTemplate: "arn:aws:iam::{{.AccountID}}:role/sensu",
+		AwsAccountsMap:     map[string]string{"222222222222": "arn:aws:iam::222222222222:role/other"},
+	}
+	handler, err := NewHandler(config, DefaultClientFactories())
+	assert.NoError(err)
+
+	roleArn, err := handler.accountRoleArn("111111111111")
+	assert.NoError(err)
+	assert.Equal("arn:aws:iam::111111111111:role/sensu", roleArn)
+	roleArn, err = handler.accountRoleArn("222222222222")
+	assert.NoError(err)
+	assert.Equal("arn:aws:iam::222222222222:role/other", roleArn)
+
+	config.AssumeRoleTemplate = "{{.AccountID}}"
+	handler, err = NewHandler(config, DefaultClientFactories())
+	assert.NoError(err)
+	_, err = handler.accountRoleArn("111111111111")
+	assert.Error(err)
+
+	config.AssumeRoleTemplate = ""
+	handler, err = NewHandler(config, DefaultClientFactories())
+	assert.NoError(err)
+	roleArn, err = handler.accountRoleArn("111111111111")
+	assert.NoError(err)
+	assert.Equal("", roleArn)
+
+	config.AssumeRoleTemplate = "{{.AccountID"
+	_, err = NewHandler(config, DefaultClientFactories())
+	assert.Error(err)
+}
+
+func TestAccountCredentialsAreCached(t *testing.T) {
+	assert := assert.New(t)
+	// The cache lives as long as the process, start and end with an empty one
+	resetAssumedRoleCredentials()
+	defer resetAssumedRoleCredentials()
+	assumed := 0
+	factories := DefaultClientFactories()
+	factories.Credentials = func(p client.ConfigProvider, roleArn string) *credentials.Credentials {
+		assumed++
+		return credentials.NewStaticCredentials(roleArn, "secret", "")
+	}
+	config := &Config{AssumeRoleTemplate: "arn:aws:iam::{{.AccountID}}:role/cached"}
+
+	for i := 0; i < 2; i++ {
+		handler, err := NewHandler(config, factories)
+		assert.NoError(err)
+		creds, err := handler.accountCredentials("333333333333")
+		assert.NoError(err)
+		value, err := creds.Get()
+		assert.NoError(err)
+		assert.Equal("arn:aws:iam::333333333333:role/cached", value.AccessKeyID)
+	}
+	assert.Equal(1, assumed)
+
+	handler, err := NewHandler(config, factories)
+	assert.NoError(err)
+	creds, err := handler.accountCredentials("")
+	assert.NoError(err)
+	assert.Nil(creds)
+}
+
+// resetAssumedRoleCredentials empties the process wide credentials cache.
+func resetAssumedRoleCredentials() {
+	assumedRoleCredentialsMutex.Lock()
+	defer assumedRoleCredentialsMutex.Unlock()
+	assumedRoleCredentials = make(map[string]*credentials.Credentials)
+}
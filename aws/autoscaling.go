@@ -0,0 +1,68 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+)
+
+// GetLifecycleStateWithContext gets the Auto Scaling lifecycle state of the
+// instance, such as InService, Standby or Terminating:Wait. An empty state is
+// returned if the instance is not part of an Auto Scaling group.
+func (awsHandler *Handler) GetLifecycleStateWithContext(ctx context.Context, instanceStatus *InstanceStatus) (string, error) {
+	clientConfig, err := awsHandler.clientConfig(instanceStatus.AccountID, instanceStatus.Region)
+	if err != nil {
+		return "", err
+	}
+	autoScalingService := awsHandler.factories.AutoScaling(awsHandler.awsSession, clientConfig)
+
+	request := &autoscaling.DescribeAutoScalingInstancesInput{
+		InstanceIds: []*string{aws.String(instanceStatus.InstanceID)},
+	}
+	var response *autoscaling.DescribeAutoScalingInstancesOutput
+	err = awsHandler.retry(ctx, "DescribeAutoScalingInstances", func() (err error) {
+		response, err = autoScalingService.DescribeAutoScalingInstancesWithContext(ctx, request)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error describing auto scaling instance %s: %s", instanceStatus.InstanceID, err)
+	}
+
+	for _, instance := range response.AutoScalingInstances {
+		if aws.StringValue(instance.InstanceId) == instanceStatus.InstanceID {
+			return aws.StringValue(instance.LifecycleState), nil
+		}
+	}
+	return "", nil
+}
+
+// MatchLifecycleState returns true if the lifecycle state matches one of the
+// patterns, for example "Terminating*" or "Standby".
+func MatchLifecycleState(patterns []string, lifecycleState string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, lifecycleState); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseLifecycleStatePatterns parses comma separated lifecycle state patterns.
+func ParseLifecycleStatePatterns(patterns string) ([]string, error) {
+	parsed := []string{}
+	for _, pattern := range strings.Split(patterns, ",") {
+		trimmedPattern := strings.TrimSpace(pattern)
+		if len(trimmedPattern) == 0 {
+			continue
+		}
+		if _, err := path.Match(trimmedPattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid lifecycle state pattern %s: %s", trimmedPattern, err)
+		}
+		parsed = append(parsed, trimmedPattern)
+	}
+	return parsed, nil
+}
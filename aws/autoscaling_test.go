@@ -0,0 +1,24 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchLifecycleState(t *testing.T) {
+	assert := assert.New(t)
+	patterns, err := ParseLifecycleStatePatterns("Terminating*, Standby,")
+	assert.NoError(err)
+	assert.Equal([]string{"Terminating*", "Standby"}, patterns)
+
+	assert.True(MatchLifecycleState(patterns, "Terminating"))
+	assert.True(MatchLifecycleState(patterns, "Terminating:Wait"))
+	assert.True(MatchLifecycleState(patterns, "Standby"))
+	assert.False(MatchLifecycleState(patterns, "EnteringStandby"))
+	assert.False(MatchLifecycleState(patterns, "InService"))
+	assert.False(MatchLifecycleState(patterns, ""))
+
+	_, err = ParseLifecycleStatePatterns("Terminating[")
+	assert.Error(err)
+}
@@ -1,16 +1,42 @@
 package aws
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/autoscaling/autoscalingiface"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-ec2-handler/retry"
+)
+
+const (
+	// describeInstanceStatusMaxInstanceIDs is the maximum number of instance
+	// IDs that can be explicitly specified in a DescribeInstanceStatus call
+	describeInstanceStatusMaxInstanceIDs = 100
+
+	errCodeInstanceIDNotFound = "InvalidInstanceID.NotFound"
+
+	// InstanceStateNotFound is the synthetic state of the instances EC2 does
+	// not know about, such as instances terminated for more than about an hour
+	InstanceStateNotFound = "not-found"
 )
 
 var (
@@ -23,27 +49,126 @@ type Config struct {
 	AwsAccessKeyID        string
 	AwsSecretKey          string
 	AwsRegion             string
+	AwsRegions            string
 	AwsInstanceID         string
 	AllowedInstanceStates string
+	InstanceStateMinAges  string
 	Timeout               uint64
 	AssumeRoleArn         string
+	AssumeRoleTemplate    string
+	AwsAccounts           string
+
+	// AutoScalingKeepStates and AutoScalingDeregisterStates are the comma
+	// separated patterns of the Auto Scaling lifecycle states keeping or
+	// deregistering an instance regardless of its EC2 state
+	AutoScalingKeepStates       string
+	AutoScalingDeregisterStates string
+
+	// TagRules are the comma separated rules on the instance tags making an
+	// instance deregisterable regardless of its EC2 state
+	TagRules string
+
+	// S3Endpoint is the endpoint of an S3 compatible storage used instead
+	// of AWS S3
+	S3Endpoint string
 
 	// Computed from the input
-	AwsAccountsMap           map[string]bool
+	AwsAccountsMap           map[string]string
+	AwsAccountsList          []string
+	AwsRegionsList           []string
 	AllowedInstanceStatesMap map[string]bool
+	InstanceStateMinAgesMap  map[string]time.Duration
+
+	AutoScalingKeepStatesList       []string
+	AutoScalingDeregisterStatesList []string
+	TagRulesList                    []*TagRule
+
+	// RetryPolicy is the policy retrying the AWS calls, it replaces the
+	// retries of the AWS SDK when it allows several attempts
+	RetryPolicy retry.Policy
+}
+
+// EC2ClientFactory creates the EC2 client used by the handler
+type EC2ClientFactory func(p client.ConfigProvider, cfgs ...*aws.Config) ec2iface.EC2API
+
+// NewEC2Client is the default EC2ClientFactory, it creates an AWS SDK EC2 client
+func NewEC2Client(p client.ConfigProvider, cfgs ...*aws.Config) ec2iface.EC2API {
+	return ec2.New(p, cfgs...)
+}
+
+// CredentialsFactory creates the credentials of an assumed role
+type CredentialsFactory func(p client.ConfigProvider, roleArn string) *credentials.Credentials
+
+// NewAssumeRoleCredentials is the default CredentialsFactory, it creates STS
+// credentials assuming the role
+func NewAssumeRoleCredentials(p client.ConfigProvider, roleArn string) *credentials.Credentials {
+	return stscreds.NewCredentials(p, roleArn)
+}
+
+// AutoScalingClientFactory creates the Auto Scaling client used by the handler
+type AutoScalingClientFactory func(p client.ConfigProvider, cfgs ...*aws.Config) autoscalingiface.AutoScalingAPI
+
+// NewAutoScalingClient is the default AutoScalingClientFactory, it creates an
+// AWS SDK Auto Scaling client
+func NewAutoScalingClient(p client.ConfigProvider, cfgs ...*aws.Config) autoscalingiface.AutoScalingAPI {
+	return autoscaling.New(p, cfgs...)
+}
+
+// S3ClientFactory creates the S3 client used by the handler
+type S3ClientFactory func(p client.ConfigProvider, cfgs ...*aws.Config) s3iface.S3API
+
+// NewS3Client is the default S3ClientFactory, it creates an AWS SDK S3 client
+func NewS3Client(p client.ConfigProvider, cfgs ...*aws.Config) s3iface.S3API {
+	return s3.New(p, cfgs...)
+}
+
+// ClientFactories are the factories creating the AWS clients and credentials
+// used by the handler
+type ClientFactories struct {
+	EC2         EC2ClientFactory
+	AutoScaling AutoScalingClientFactory
+	S3          S3ClientFactory
+	Credentials CredentialsFactory
+}
+
+// DefaultClientFactories returns the factories creating AWS SDK clients
+func DefaultClientFactories() ClientFactories {
+	return ClientFactories{
+		EC2:         NewEC2Client,
+		AutoScaling: NewAutoScalingClient,
+		S3:          NewS3Client,
+		Credentials: NewAssumeRoleCredentials,
+	}
+}
+
+// InstanceStatus is the state of an instance along with the account and region
+// it was found in. The account is empty when the instance was found using the
+// default credentials.
+type InstanceStatus struct {
+	InstanceID string
+	AccountID  string
+	Region     string
+	State      string
 }
 
 // Handler is the aws handler
 type Handler struct {
-	config     *Config
-	awsSession *session.Session
-	ec2Service *ec2.EC2
+	config         *Config
+	factories      ClientFactories
+	awsSession     *session.Session
+	awsCredentials *credentials.Credentials
+	roleTemplate   *template.Template
+
+	ec2ServicesMutex sync.Mutex
+	ec2Services      map[string]ec2iface.EC2API
 }
 
-// NewHandler creates a new handler
-func NewHandler(config *Config) (*Handler, error) {
+// NewHandler creates a new handler using the factories to create its clients
+func NewHandler(config *Config, factories ClientFactories) (*Handler, error) {
 	handler := Handler{
-		config: config,
+		config:      config,
+		factories:   factories,
+		ec2Services: make(map[string]ec2iface.EC2API),
 	}
 
 	err := handler.initAws()
@@ -78,35 +203,317 @@ func (awsHandler *Handler) initAws() error {
 
 	if arn.IsARN(awsHandler.config.AssumeRoleArn) {
 		log.Println("Using Role ARN")
-		creds := stscreds.NewCredentials(awsHandler.awsSession, awsHandler.config.AssumeRoleArn)
-		awsHandler.ec2Service = ec2.New(awsHandler.awsSession, &aws.Config{Credentials: creds})
-	} else {
-		awsHandler.ec2Service = ec2.New(awsHandler.awsSession)
+		awsHandler.awsCredentials = awsHandler.factories.Credentials(awsHandler.awsSession, awsHandler.config.AssumeRoleArn)
+	}
+
+	if len(awsHandler.config.AssumeRoleTemplate) > 0 {
+		roleTemplate, err := ParseRoleTemplate(awsHandler.config.AssumeRoleTemplate)
+		if err != nil {
+			return err
+		}
+		awsHandler.roleTemplate = roleTemplate
 	}
 
 	return nil
 }
 
+// ec2Service returns the EC2 client of the account and region, creating it if
+// needed. The default credentials are used when the account is empty.
+func (awsHandler *Handler) ec2Service(accountID string, region string) (ec2iface.EC2API, error) {
+	awsHandler.ec2ServicesMutex.Lock()
+	defer awsHandler.ec2ServicesMutex.Unlock()
+
+	key := accountID + "/" + region
+	if ec2Service, ok := awsHandler.ec2Services[key]; ok {
+		return ec2Service, nil
+	}
+	ec2Config, err := awsHandler.clientConfig(accountID, region)
+	if err != nil {
+		return nil, err
+	}
+	ec2Service := awsHandler.factories.EC2(awsHandler.awsSession, ec2Config)
+	awsHandler.ec2Services[key] = ec2Service
+	return ec2Service, nil
+}
+
+// clientConfig returns the configuration of the AWS clients of the account and
+// region.
+func (awsHandler *Handler) clientConfig(accountID string, region string) (*aws.Config, error) {
+	creds, err := awsHandler.accountCredentials(accountID)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig := &aws.Config{
+		Region:      aws.String(region),
+		Credentials: creds,
+	}
+	if awsHandler.config.RetryPolicy.MaxAttempts > 0 {
+		clientConfig.MaxRetries = aws.Int(0)
+	}
+	return clientConfig, nil
+}
+
 // GetInstanceState gets the instance state
 func (awsHandler *Handler) GetInstanceState() (string, error) {
-	instanceID := awsHandler.config.AwsInstanceID
+	instanceStatus, err := awsHandler.GetInstanceStatusWithContext(context.Background(), awsHandler.config.AwsInstanceID, "", awsHandler.config.AwsRegion)
+	if err != nil {
+		return "", err
+	}
+	return instanceStatus.State, nil
+}
+
+// GetInstanceStatus gets the status of an instance, looking for it in the
+// account and region first. See GetInstanceStatuses for how the instance is
+// searched if it is not found there, and the state of instances that could not
+// be found.
+func (awsHandler *Handler) GetInstanceStatus(instanceID string, accountID string, region string) (*InstanceStatus, error) {
+	return awsHandler.GetInstanceStatusWithContext(context.Background(), instanceID, accountID, region)
+}
+
+// GetInstanceStatusWithContext is GetInstanceStatus with a context, the AWS
+// calls are canceled when the context is done.
+func (awsHandler *Handler) GetInstanceStatusWithContext(ctx context.Context, instanceID string, accountID string, region string) (*InstanceStatus, error) {
 	log.Printf("Retrieving AWS instance state for %s\n", instanceID)
 
+	instanceStatuses, err := awsHandler.GetInstanceStatusesWithContext(ctx, []string{instanceID}, accountID, region)
+	if err != nil {
+		return nil, fmt.Errorf("error getting instance state for %s: %s", instanceID, err)
+	}
+	return instanceStatuses[instanceID], nil
+}
+
+// GetInstanceStatuses gets the statuses of several instances, batching the
+// DescribeInstanceStatus calls. The instances are looked up in the region,
+// which defaults to the configured region when empty. The region is only a
+// guess then, and the instances not found there are searched in parallel in the
+// configured regions, or in every enabled region if none is configured. A known
+// region is the only one searched. When the account is unknown, the
+// instances are searched with the default credentials first, then in each of
+// the configured accounts. Instances that could not be found anywhere have the
+// InstanceStateNotFound state. Errors other than unknown instances, such as
+// throttling or authorization errors, are returned.
+func (awsHandler *Handler) GetInstanceStatuses(instanceIDs []string, accountID string, region string) (map[string]*InstanceStatus, error) {
+	return awsHandler.GetInstanceStatusesWithContext(context.Background(), instanceIDs, accountID, region)
+}
+
+// GetInstanceStatusesWithContext is GetInstanceStatuses with a context, the
+// AWS calls are canceled when the context is done.
+func (awsHandler *Handler) GetInstanceStatusesWithContext(ctx context.Context, instanceIDs []string, accountID string, region string) (map[string]*InstanceStatus, error) {
+	// Only search the other regions when the region of the instances is
+	// unknown, each missing instance would otherwise cost a call per region
+	searchOtherRegions := len(region) == 0
+	if searchOtherRegions {
+		region = awsHandler.config.AwsRegion
+	}
+
+	accountIDs := []string{accountID}
+	if len(accountID) == 0 {
+		accountIDs = append(accountIDs, awsHandler.config.AwsAccountsList...)
+	}
+
+	instanceStatuses := make(map[string]*InstanceStatus, len(instanceIDs))
+	for _, searchAccountID := range accountIDs {
+		missingInstanceIDs := missingInstances(instanceIDs, instanceStatuses)
+		if len(missingInstanceIDs) == 0 {
+			break
+		}
+		if len(searchAccountID) > 0 {
+			log.Printf("Searching %d instances in account %s\n", len(missingInstanceIDs), searchAccountID)
+		}
+		if err := awsHandler.searchAccount(ctx, searchAccountID, region, searchOtherRegions, missingInstanceIDs, instanceStatuses); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, instanceID := range missingInstances(instanceIDs, instanceStatuses) {
+		log.Printf("Instance %s not found\n", instanceID)
+		instanceStatuses[instanceID] = &InstanceStatus{
+			InstanceID: instanceID,
+			AccountID:  accountID,
+			Region:     region,
+			State:      InstanceStateNotFound,
+		}
+	}
+
+	return instanceStatuses, nil
+}
+
+// searchAccount looks up the instances in the region of the account, then
+// searches the instances not found there in the other regions if enabled.
+func (awsHandler *Handler) searchAccount(ctx context.Context, accountID string, region string, searchOtherRegions bool, instanceIDs []string, instanceStatuses map[string]*InstanceStatus) error {
+	if err := awsHandler.describeInstanceStatuses(ctx, accountID, region, instanceIDs, instanceStatuses); err != nil {
+		return err
+	}
+	missingInstanceIDs := missingInstances(instanceIDs, instanceStatuses)
+	if len(missingInstanceIDs) == 0 || !searchOtherRegions {
+		return nil
+	}
+
+	searchRegions, err := awsHandler.searchRegions(ctx, accountID, region)
+	if err != nil {
+		return err
+	}
+	log.Printf("%d instances not found in %s, searching %d other regions\n", len(missingInstanceIDs), region, len(searchRegions))
+
+	var (
+		wait      sync.WaitGroup
+		mutex     sync.Mutex
+		searchErr error
+	)
+	for _, searchRegion := range searchRegions {
+		wait.Add(1)
+		go func(searchRegion string) {
+			defer wait.Done()
+			found := make(map[string]*InstanceStatus)
+			err := awsHandler.describeInstanceStatuses(ctx, accountID, searchRegion, missingInstanceIDs, found)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				searchErr = fmt.Errorf("error searching region %s: %s", searchRegion, err)
+				return
+			}
+			for instanceID, instanceStatus := range found {
+				instanceStatuses[instanceID] = instanceStatus
+			}
+		}(searchRegion)
+	}
+	wait.Wait()
+
+	// Errors only matter if they may have hidden some instances
+	if searchErr != nil && len(missingInstances(instanceIDs, instanceStatuses)) > 0 {
+		return searchErr
+	}
+
+	return nil
+}
+
+// searchRegions returns the regions of the account to search for instances,
+// other than the region already searched.
+func (awsHandler *Handler) searchRegions(ctx context.Context, accountID string, searchedRegion string) ([]string, error) {
+	regions := awsHandler.config.AwsRegionsList
+	if len(regions) == 0 {
+		ec2Service, err := awsHandler.ec2Service(accountID, awsHandler.config.AwsRegion)
+		if err != nil {
+			return nil, err
+		}
+		var response *ec2.DescribeRegionsOutput
+		err = awsHandler.retry(ctx, "DescribeRegions", func() (err error) {
+			response, err = ec2Service.DescribeRegionsWithContext(ctx, &ec2.DescribeRegionsInput{})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error describing regions: %s", err)
+		}
+		for _, region := range response.Regions {
+			regions = append(regions, aws.StringValue(region.RegionName))
+		}
+	}
+
+	searchRegions := make([]string, 0, len(regions))
+	for _, region := range regions {
+		if region != searchedRegion {
+			searchRegions = append(searchRegions, region)
+		}
+	}
+	return searchRegions, nil
+}
+
+// describeInstanceStatuses describes the instances of the account and region
+// in batches, adding the statuses found to instanceStatuses. Unknown instances
+// are not considered an error, they are absent from instanceStatuses.
+func (awsHandler *Handler) describeInstanceStatuses(ctx context.Context, accountID string, region string, instanceIDs []string, instanceStatuses map[string]*InstanceStatus) error {
+	for start := 0; start < len(instanceIDs); start += describeInstanceStatusMaxInstanceIDs {
+		end := start + describeInstanceStatusMaxInstanceIDs
+		if end > len(instanceIDs) {
+			end = len(instanceIDs)
+		}
+		batch := instanceIDs[start:end]
+
+		err := awsHandler.describeInstanceStatusBatch(ctx, accountID, region, batch, instanceStatuses)
+		if isInstanceIDNotFound(err) && len(batch) > 1 {
+			// A single unknown instance fails the whole batch, retry the
+			// instances one by one to find out which ones still exist
+			for _, instanceID := range batch {
+				err = awsHandler.describeInstanceStatusBatch(ctx, accountID, region, []string{instanceID}, instanceStatuses)
+				if err != nil && !isInstanceIDNotFound(err) {
+					return err
+				}
+			}
+		} else if err != nil && !isInstanceIDNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (awsHandler *Handler) describeInstanceStatusBatch(ctx context.Context, accountID string, region string, instanceIDs []string, instanceStatuses map[string]*InstanceStatus) error {
+	ec2Service, err := awsHandler.ec2Service(accountID, region)
+	if err != nil {
+		return err
+	}
 	request := &ec2.DescribeInstanceStatusInput{
-		InstanceIds:         []*string{aws.String(instanceID)},
+		InstanceIds:         aws.StringSlice(instanceIDs),
 		IncludeAllInstances: &describeInstanceStatusIncludeAllInstances,
 	}
-	response, err := awsHandler.ec2Service.DescribeInstanceStatus(request)
+	var response *ec2.DescribeInstanceStatusOutput
+	err = awsHandler.retry(ctx, "DescribeInstanceStatus", func() (err error) {
+		response, err = ec2Service.DescribeInstanceStatusWithContext(ctx, request)
+		return err
+	})
 	if err != nil {
-		return "", fmt.Errorf("error getting instance state for %s: %s", instanceID, err)
+		return err
+	}
+
+	if len(instanceIDs) == 1 && len(response.InstanceStatuses) > 1 {
+		return fmt.Errorf("more than one instance found for %s", instanceIDs[0])
+	}
+	for _, instanceStatus := range response.InstanceStatuses {
+		instanceID := aws.StringValue(instanceStatus.InstanceId)
+		instanceStatuses[instanceID] = &InstanceStatus{
+			InstanceID: instanceID,
+			AccountID:  accountID,
+			Region:     region,
+			State:      aws.StringValue(instanceStatus.InstanceState.Name),
+		}
 	}
+	return nil
+}
 
-	instanceStatuses := response.InstanceStatuses
-	if len(instanceStatuses) == 0 {
-		return "", fmt.Errorf("could not get status for %s", instanceID)
-	} else if len(instanceStatuses) > 1 {
-		return "", fmt.Errorf("more than one instance found for %s", instanceID)
+// retry calls the AWS operation with the retry policy of the configuration.
+func (awsHandler *Handler) retry(ctx context.Context, operation string, fn func() error) error {
+	return awsHandler.config.RetryPolicy.Do(ctx, operation, isRetryableError, fn)
+}
+
+// isRetryableError returns true for throttling errors, server errors and
+// transient network errors.
+func isRetryableError(err error) bool {
+	if request.IsErrorThrottle(err) {
+		return true
+	}
+	if requestFailure, ok := err.(awserr.RequestFailure); ok && requestFailure.StatusCode() >= 500 {
+		return true
 	}
+	if _, ok := err.(awserr.Error); ok {
+		return request.IsErrorRetryable(err)
+	}
+	return false
+}
+
+func missingInstances(instanceIDs []string, instanceStatuses map[string]*InstanceStatus) []string {
+	missingInstanceIDs := []string{}
+	for _, instanceID := range instanceIDs {
+		if _, ok := instanceStatuses[instanceID]; !ok {
+			missingInstanceIDs = append(missingInstanceIDs, instanceID)
+		}
+	}
+	return missingInstanceIDs
+}
 
-	return *instanceStatuses[0].InstanceState.Name, nil
+func isInstanceIDNotFound(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == errCodeInstanceIDNotFound
+	}
+	return false
 }
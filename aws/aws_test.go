@@ -0,0 +1,21 @@
+package aws
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRetryableError(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(isRetryableError(awserr.New("RequestLimitExceeded", "Request limit exceeded.", nil)))
+	assert.True(isRetryableError(awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), 503, "")))
+	assert.True(isRetryableError(awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset by peer"))))
+	assert.False(isRetryableError(awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)))
+	assert.False(isRetryableError(awserr.NewRequestFailure(awserr.New("InvalidInstanceID.NotFound", "", nil), 400, "")))
+	assert.False(isRetryableError(awserr.New(request.CanceledErrorCode, "request context canceled", nil)))
+	assert.False(isRetryableError(errors.New("more than one instance found")))
+}
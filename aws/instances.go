@@ -0,0 +1,212 @@
+package aws
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+const (
+	stateTransitionTimeLayout = "2006-01-02 15:04:05"
+
+	// StateReasonUserInitiated is the category of the state reasons of
+	// instances stopped or terminated by a user or from the instance
+	StateReasonUserInitiated = "user-initiated"
+	// StateReasonSpotInterruption is the category of the state reasons of
+	// Spot instances interrupted by EC2
+	StateReasonSpotInterruption = "spot-interruption"
+	// StateReasonHibernation is the category of the state reasons of
+	// hibernated instances
+	StateReasonHibernation = "hibernation"
+	// StateReasonSystemError is the category of the state reasons of
+	// instances stopped or terminated by an EC2 error or retirement
+	StateReasonSystemError = "system-error"
+	// StateReasonOther is the category of unknown state reasons
+	StateReasonOther = "other"
+	// StateReasonNone is the category of instances without a state reason
+	StateReasonNone = "none"
+)
+
+var (
+	// StateReasonCategories are the categories of the EC2 state reasons
+	StateReasonCategories = []string{
+		StateReasonUserInitiated,
+		StateReasonSpotInterruption,
+		StateReasonHibernation,
+		StateReasonSystemError,
+		StateReasonOther,
+		StateReasonNone,
+	}
+
+	// stateReasonCodeCategories maps the EC2 state reason codes to their
+	// category
+	stateReasonCodeCategories = map[string]string{
+		"Client.UserInitiatedShutdown":        StateReasonUserInitiated,
+		"Client.InstanceInitiatedShutdown":    StateReasonUserInitiated,
+		"Client.InstanceTerminated":           StateReasonUserInitiated,
+		"Server.SpotInstanceTermination":      StateReasonSpotInterruption,
+		"Server.SpotInstanceShutdown":         StateReasonSpotInterruption,
+		"Client.UserInitiatedHibernate":       StateReasonHibernation,
+		"Server.InternalError":                StateReasonSystemError,
+		"Server.InsufficientInstanceCapacity": StateReasonSystemError,
+		"Server.ScheduledStop":                StateReasonSystemError,
+		"Client.InternalError":                StateReasonSystemError,
+		"Client.VolumeLimitExceeded":          StateReasonSystemError,
+		"Client.InvalidSnapshot.NotFound":     StateReasonSystemError,
+	}
+
+	// stateTransitionTimeRegexp matches the time EC2 appends to the state
+	// transition reason, for example "User initiated (2020-12-01 12:00:00 GMT)"
+	stateTransitionTimeRegexp = regexp.MustCompile(`\((\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}) GMT\)`)
+)
+
+// Instance is the description of an instance, as returned by DescribeInstances.
+// InstanceLifecycle is "spot" or "scheduled", and empty for On-Demand
+// instances. The state reason is only set for some state transitions, for
+// example "Client.UserInitiatedShutdown" when the instance was terminated by a
+// user.
+type Instance struct {
+	InstanceID            string            `json:"instance_id"`
+	InstanceType          string            `json:"instance_type"`
+	LaunchTime            *time.Time        `json:"launch_time"`
+	Tags                  map[string]string `json:"tags"`
+	VpcID                 string            `json:"vpc_id"`
+	InstanceLifecycle     string            `json:"instance_lifecycle"`
+	StateReasonCode       string            `json:"state_reason_code"`
+	StateReasonMessage    string            `json:"state_reason_message"`
+	StateReasonCategory   string            `json:"state_reason_category"`
+	StateTransitionReason string            `json:"state_transition_reason"`
+
+	// Description is the full description returned by EC2
+	Description *ec2.Instance `json:"-"`
+
+	state string
+}
+
+// NewInstance creates the typed instance of an EC2 instance description.
+func NewInstance(description *ec2.Instance) *Instance {
+	instance := &Instance{
+		InstanceID:            aws.StringValue(description.InstanceId),
+		InstanceType:          aws.StringValue(description.InstanceType),
+		LaunchTime:            description.LaunchTime,
+		Tags:                  make(map[string]string, len(description.Tags)),
+		VpcID:                 aws.StringValue(description.VpcId),
+		InstanceLifecycle:     aws.StringValue(description.InstanceLifecycle),
+		StateTransitionReason: aws.StringValue(description.StateTransitionReason),
+		Description:           description,
+	}
+	if description.State != nil {
+		instance.state = aws.StringValue(description.State.Name)
+	}
+	for _, tag := range description.Tags {
+		instance.Tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	if description.StateReason != nil {
+		instance.StateReasonCode = aws.StringValue(description.StateReason.Code)
+		instance.StateReasonMessage = aws.StringValue(description.StateReason.Message)
+	}
+	instance.StateReasonCategory = StateReasonCategory(instance.StateReasonCode)
+	return instance
+}
+
+// StateReasonCategory returns the category of the EC2 state reason code.
+func StateReasonCategory(code string) string {
+	if len(code) == 0 {
+		return StateReasonNone
+	}
+	if category, ok := stateReasonCodeCategories[code]; ok {
+		return category
+	}
+	return StateReasonOther
+}
+
+// IsSpot returns true if the instance is a Spot instance.
+func (instance *Instance) IsSpot() bool {
+	return instance.InstanceLifecycle == ec2.InstanceLifecycleTypeSpot
+}
+
+// Lifecycle returns the lifecycle of the instance, "spot", "scheduled" or
+// "on-demand".
+func (instance *Instance) Lifecycle() string {
+	if len(instance.InstanceLifecycle) == 0 {
+		return "on-demand"
+	}
+	return instance.InstanceLifecycle
+}
+
+// StateTransitionTime returns the time the instance entered its current state,
+// read from the state transition reason, falling back to the launch time of
+// pending and running instances. The zero time is returned otherwise, the
+// launch time of a stopped or terminated instance says nothing of how long it
+// has been in its state.
+func (instance *Instance) StateTransitionTime() time.Time {
+	return stateTransitionTime(instance.InstanceID, instance.state, instance.StateTransitionReason, aws.TimeValue(instance.LaunchTime))
+}
+
+// GetInstance describes the instance in the account and region it was found
+// in.
+func (awsHandler *Handler) GetInstance(instanceStatus *InstanceStatus) (*Instance, error) {
+	return awsHandler.GetInstanceWithContext(context.Background(), instanceStatus)
+}
+
+// GetInstanceWithContext is GetInstance with a context, the AWS calls are
+// canceled when the context is done.
+func (awsHandler *Handler) GetInstanceWithContext(ctx context.Context, instanceStatus *InstanceStatus) (*Instance, error) {
+	description, err := awsHandler.describeInstance(ctx, instanceStatus)
+	if err != nil {
+		return nil, err
+	}
+	return NewInstance(description), nil
+}
+
+// stateTransitionTime reads the time from the state transition reason,
+// falling back to the launch time of pending and running instances.
+func stateTransitionTime(instanceID string, state string, reason string, launchTime time.Time) time.Time {
+	if matches := stateTransitionTimeRegexp.FindStringSubmatch(reason); matches != nil {
+		transitionTime, err := time.Parse(stateTransitionTimeLayout, matches[1])
+		if err == nil {
+			return transitionTime
+		}
+		log.Printf("Invalid state transition time for %s: %s\n", instanceID, reason)
+	}
+
+	if state == ec2.InstanceStateNamePending || state == ec2.InstanceStateNameRunning {
+		return launchTime
+	}
+	return time.Time{}
+}
+
+// describeInstance describes the instance in the account and region it was
+// found in.
+func (awsHandler *Handler) describeInstance(ctx context.Context, instanceStatus *InstanceStatus) (*ec2.Instance, error) {
+	ec2Service, err := awsHandler.ec2Service(instanceStatus.AccountID, instanceStatus.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &ec2.DescribeInstancesInput{
+		InstanceIds: []*string{aws.String(instanceStatus.InstanceID)},
+	}
+	var response *ec2.DescribeInstancesOutput
+	err = awsHandler.retry(ctx, "DescribeInstances", func() (err error) {
+		response, err = ec2Service.DescribeInstancesWithContext(ctx, request)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error describing instance %s: %s", instanceStatus.InstanceID, err)
+	}
+
+	for _, reservation := range response.Reservations {
+		for _, instance := range reservation.Instances {
+			if aws.StringValue(instance.InstanceId) == instanceStatus.InstanceID {
+				return instance, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("could not describe instance %s", instanceStatus.InstanceID)
+}
@@ -0,0 +1,60 @@
+package aws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewInstance(t *testing.T) {
+	assert := assert.New(t)
+	launchTime := time.Date(2020, 12, 1, 12, 0, 0, 0, time.UTC)
+	description := &ec2.Instance{
+		InstanceId:            aws.String("i-1234567890abcdef0"),
+		InstanceType:          aws.String("t3.micro"),
+		LaunchTime:            &launchTime,
+		StateReason:           &ec2.StateReason{Code: aws.String("Client.UserInitiatedShutdown"), Message: aws.String("Client.UserInitiatedShutdown: User initiated shutdown")},
+		StateTransitionReason: aws.String("User initiated (2020-12-02 12:00:00 GMT)"),
+		Tags:                  []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String("web-1")}},
+	}
+
+	instance := NewInstance(description)
+	assert.Equal("i-1234567890abcdef0", instance.InstanceID)
+	assert.Equal("t3.micro", instance.InstanceType)
+	assert.Equal(map[string]string{"Name": "web-1"}, instance.Tags)
+	assert.Equal("Client.UserInitiatedShutdown", instance.StateReasonCode)
+	assert.Equal(StateReasonUserInitiated, instance.StateReasonCategory)
+	assert.Equal("on-demand", instance.Lifecycle())
+	assert.False(instance.IsSpot())
+	assert.Equal(time.Date(2020, 12, 2, 12, 0, 0, 0, time.UTC), instance.StateTransitionTime())
+
+	description.InstanceLifecycle = aws.String(ec2.InstanceLifecycleTypeSpot)
+	description.StateReason = nil
+	description.StateTransitionReason = nil
+	instance = NewInstance(description)
+	assert.Equal("spot", instance.Lifecycle())
+	assert.True(instance.IsSpot())
+	assert.Equal("", instance.StateReasonCode)
+	assert.True(instance.StateTransitionTime().IsZero())
+
+	description.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameRunning)}
+	instance = NewInstance(description)
+	assert.Equal(launchTime, instance.StateTransitionTime())
+
+	description.State = &ec2.InstanceState{Name: aws.String(ec2.InstanceStateNameStopped)}
+	instance = NewInstance(description)
+	assert.True(instance.StateTransitionTime().IsZero())
+}
+
+func TestStateReasonCategory(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(StateReasonUserInitiated, StateReasonCategory("Client.UserInitiatedShutdown"))
+	assert.Equal(StateReasonSpotInterruption, StateReasonCategory("Server.SpotInstanceTermination"))
+	assert.Equal(StateReasonHibernation, StateReasonCategory("Client.UserInitiatedHibernate"))
+	assert.Equal(StateReasonSystemError, StateReasonCategory("Server.InternalError"))
+	assert.Equal(StateReasonOther, StateReasonCategory("Server.Unknown"))
+	assert.Equal(StateReasonNone, StateReasonCategory(""))
+}
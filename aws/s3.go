@@ -0,0 +1,108 @@
+package aws
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// PutObjectWithContext uploads the content to the key of the S3 bucket, with
+// the default credentials in the configured region. When an S3 endpoint is
+// configured, the object is uploaded to that S3 compatible storage with
+// path-style addressing.
+func (awsHandler *Handler) PutObjectWithContext(ctx context.Context, bucket string, key string, content []byte, contentType string) error {
+	s3Service, err := awsHandler.s3Service()
+	if err != nil {
+		return err
+	}
+
+	err = awsHandler.retry(ctx, "PutObject", func() error {
+		// The body is read by each attempt, the request is built again with
+		// a new reader so that retries do not upload an empty object
+		request := &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(content),
+			ContentType: aws.String(contentType),
+		}
+		_, err := s3Service.PutObjectWithContext(ctx, request)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading s3://%s/%s: %s", bucket, key, err)
+	}
+	return nil
+}
+
+// ListObjectsWithContext lists the keys of the objects of the S3 bucket
+// starting with the prefix, following the pagination.
+func (awsHandler *Handler) ListObjectsWithContext(ctx context.Context, bucket string, prefix string) ([]string, error) {
+	s3Service, err := awsHandler.s3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	request := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	err = awsHandler.retry(ctx, "ListObjectsV2", func() error {
+		keys = []string{}
+		return s3Service.ListObjectsV2PagesWithContext(ctx, request, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing s3://%s/%s: %s", bucket, prefix, err)
+	}
+	return keys, nil
+}
+
+// GetObjectWithContext downloads the content of the key of the S3 bucket.
+func (awsHandler *Handler) GetObjectWithContext(ctx context.Context, bucket string, key string) ([]byte, error) {
+	s3Service, err := awsHandler.s3Service()
+	if err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	request := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	err = awsHandler.retry(ctx, "GetObject", func() error {
+		output, err := s3Service.GetObjectWithContext(ctx, request)
+		if err != nil {
+			return err
+		}
+		defer output.Body.Close()
+		content, err = ioutil.ReadAll(output.Body)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error downloading s3://%s/%s: %s", bucket, key, err)
+	}
+	return content, nil
+}
+
+// s3Service returns the S3 client of the configured region.
+func (awsHandler *Handler) s3Service() (s3iface.S3API, error) {
+	clientConfig, err := awsHandler.clientConfig("", awsHandler.config.AwsRegion)
+	if err != nil {
+		return nil, err
+	}
+	if len(awsHandler.config.S3Endpoint) > 0 {
+		clientConfig.Endpoint = aws.String(awsHandler.config.S3Endpoint)
+		clientConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+	return awsHandler.factories.S3(awsHandler.awsSession, clientConfig), nil
+}
@@ -0,0 +1,87 @@
+package aws
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// TagRule is a predicate on the tags of an instance. A rule is written "key"
+// to match instances having the tag, "key=value" to match the tag value,
+// "key~regexp" to match the tag value against a regular expression, and any
+// rule prefixed with "!" matches the instances the rule does not match.
+type TagRule struct {
+	Key    string
+	Value  string
+	Regexp *regexp.Regexp
+	Not    bool
+
+	equals bool
+	text   string
+}
+
+// ParseTagRules parses comma separated tag rules, for example
+// "monitoring=disabled,decommissioned~^(true|yes)$,!owner".
+func ParseTagRules(rules string) ([]*TagRule, error) {
+	parsed := []*TagRule{}
+	for _, rule := range strings.Split(rules, ",") {
+		trimmedRule := strings.TrimSpace(rule)
+		if len(trimmedRule) == 0 {
+			continue
+		}
+		tagRule, err := ParseTagRule(trimmedRule)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, tagRule)
+	}
+	return parsed, nil
+}
+
+// ParseTagRule parses a single tag rule.
+func ParseTagRule(rule string) (*TagRule, error) {
+	tagRule := &TagRule{text: rule}
+	predicate := rule
+	if strings.HasPrefix(predicate, "!") {
+		tagRule.Not = true
+		predicate = strings.TrimSpace(predicate[1:])
+	}
+
+	switch index := strings.IndexAny(predicate, "=~"); {
+	case index < 0:
+		tagRule.Key = predicate
+	case predicate[index] == '=':
+		tagRule.Key = strings.TrimSpace(predicate[:index])
+		tagRule.Value = strings.TrimSpace(predicate[index+1:])
+		tagRule.equals = true
+	default:
+		tagRule.Key = strings.TrimSpace(predicate[:index])
+		valueRegexp, err := regexp.Compile(strings.TrimSpace(predicate[index+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag rule %s: %s", rule, err)
+		}
+		tagRule.Regexp = valueRegexp
+	}
+	if len(tagRule.Key) == 0 {
+		return nil, fmt.Errorf("invalid tag rule %s: missing tag key", rule)
+	}
+	return tagRule, nil
+}
+
+// Match returns true if the tags match the rule.
+func (tagRule *TagRule) Match(tags map[string]string) bool {
+	value, ok := tags[tagRule.Key]
+	switch {
+	case !ok:
+	case tagRule.Regexp != nil:
+		ok = tagRule.Regexp.MatchString(value)
+	case tagRule.equals:
+		ok = value == tagRule.Value
+	}
+	return ok != tagRule.Not
+}
+
+// String returns the rule as written.
+func (tagRule *TagRule) String() string {
+	return tagRule.text
+}
@@ -0,0 +1,56 @@
+package aws
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTagRules(t *testing.T) {
+	tags := map[string]string{
+		"monitoring":     "disabled",
+		"decommissioned": "yes",
+		"Name":           "web-1",
+	}
+	testCases := []struct {
+		rule     string
+		expected bool
+	}{
+		{rule: "monitoring", expected: true},
+		{rule: "owner", expected: false},
+		{rule: "monitoring=disabled", expected: true},
+		{rule: "monitoring=enabled", expected: false},
+		{rule: "monitoring=", expected: false},
+		{rule: "decommissioned~^(true|yes)$", expected: true},
+		{rule: "Name~^db-", expected: false},
+		{rule: "!owner", expected: true},
+		{rule: "!monitoring=disabled", expected: false},
+		{rule: "! Name~^db-", expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.rule, func(t *testing.T) {
+			tagRule, err := ParseTagRule(tc.rule)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.expected, tagRule.Match(tags))
+				assert.Equal(t, tc.rule, tagRule.String())
+			}
+		})
+	}
+}
+
+func TestParseTagRules(t *testing.T) {
+	assert := assert.New(t)
+	rules, err := ParseTagRules("monitoring=disabled, decommissioned=true,")
+	assert.NoError(err)
+	if assert.Equal(2, len(rules)) {
+		assert.Equal("monitoring", rules[0].Key)
+		assert.Equal("disabled", rules[0].Value)
+		assert.Equal("decommissioned", rules[1].Key)
+	}
+
+	for _, rule := range []string{"=disabled", "!", "name~[", "~^web"} {
+		_, err = ParseTagRules(rule)
+		assert.Error(err, rule)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/httpclient"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+const (
+	// deletionStateVersion is the version of the circuit breaker state file
+	deletionStateVersion = 1
+
+	// circuitBreakerCheck is the check name of the circuit breaker events
+	circuitBreakerCheck = "ec2-deletion-circuit-breaker"
+
+	// staleLockAge is the age after which the lock of the state file is
+	// considered left behind by a crashed run and removed
+	staleLockAge = 30 * time.Second
+)
+
+// deletionState is the circuit breaker state, shared by the handler and
+// reconcile runs through the state file.
+type deletionState struct {
+	Version    int                            `json:"version"`
+	Namespaces map[string]*namespaceDeletions `json:"namespaces"`
+}
+
+// namespaceDeletions are the recent deletions of a namespace, and whether the
+// circuit breaker of the namespace is open.
+type namespaceDeletions struct {
+	Deletions []time.Time `json:"deletions"`
+	Open      bool        `json:"open"`
+}
+
+// reserveDeletion records the deletion of the entity in the circuit breaker
+// state, unless the maximum number of deletions within the window is reached
+// in its namespace. The circuit breaker then opens, the deletion is refused
+// and an alert event is posted. The circuit breaker closes on the first
+// deletion allowed again, posting a resolution event.
+func reserveDeletion(ctx context.Context, client *httpclient.CoreClient, entity *corev2.Entity) error {
+	if maxDeletions <= 0 {
+		return nil
+	}
+
+	var deletions int
+	var allowed, opened, closed bool
+	err := withStateLock(ctx, maxDeletionsStateFile, func() error {
+		state, err := loadDeletionState(maxDeletionsStateFile)
+		if err != nil {
+			return err
+		}
+		namespace, ok := state.Namespaces[entity.Namespace]
+		if !ok {
+			namespace = &namespaceDeletions{}
+			state.Namespaces[entity.Namespace] = namespace
+		}
+
+		now := time.Now().UTC()
+		recent := []time.Time{}
+		for _, deletion := range namespace.Deletions {
+			if now.Sub(deletion) < maxDeletionsWindowDuration {
+				recent = append(recent, deletion)
+			}
+		}
+		namespace.Deletions = recent
+		deletions = len(recent)
+
+		if deletions >= maxDeletions {
+			opened = !namespace.Open
+			namespace.Open = true
+		} else {
+			allowed = true
+			closed = namespace.Open
+			namespace.Open = false
+			namespace.Deletions = append(namespace.Deletions, now)
+		}
+		return saveDeletionState(maxDeletionsStateFile, state)
+	})
+	if err != nil {
+		return fmt.Errorf("could not update circuit breaker state, refusing to delete entity: %s", err)
+	}
+
+	if closed {
+		output := fmt.Sprintf("Entity deletions resumed in namespace %s\n", entity.Namespace)
+		if err := postCircuitBreakerEvent(ctx, client, entity.Namespace, output, 0); err != nil {
+			log.Printf("%s\n", err)
+		}
+	}
+	if allowed {
+		return nil
+	}
+
+	refusal := fmt.Errorf("circuit breaker open, refusing to delete entity %s/%s: %d entities deleted in namespace %s within %s",
+		entity.Namespace, entity.Name, deletions, entity.Namespace, maxDeletionsWindowDuration)
+	if !opened {
+		return refusal
+	}
+	output := fmt.Sprintf("Refused to delete entity %s/%s, %d entities were deleted in namespace %s within %s, the limit is %d\n",
+		entity.Namespace, entity.Name, deletions, entity.Namespace, maxDeletionsWindowDuration, maxDeletions)
+	if err := postCircuitBreakerEvent(ctx, client, entity.Namespace, output, 2); err != nil {
+		return fmt.Errorf("%s, %s", refusal, err)
+	}
+	return refusal
+}
+
+// postCircuitBreakerEvent posts the circuit breaker event against the
+// configured proxy entity.
+func postCircuitBreakerEvent(ctx context.Context, client *httpclient.CoreClient, namespace, output string, status int) error {
+	request := newProxyEventRequest(namespace, maxDeletionsEventEntity, circuitBreakerCheck, output, status)
+	log.Printf("Posting circuit breaker event (%s/%s/%s)", namespace, maxDeletionsEventEntity, circuitBreakerCheck)
+	if err := postEvent(ctx, client, "Posting circuit breaker event", request); err != nil {
+		return fmt.Errorf("could not post circuit breaker event: %s", err)
+	}
+	return nil
+}
+
+// loadDeletionState reads the circuit breaker state file, a missing file is
+// an empty state.
+func loadDeletionState(path string) (*deletionState, error) {
+	state := &deletionState{Version: deletionStateVersion}
+	stateBytes, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(stateBytes, state); err != nil {
+			return nil, fmt.Errorf("error unmarshalling %s: %s", path, err)
+		}
+		if state.Version != deletionStateVersion {
+			return nil, fmt.Errorf("unsupported state file version %d", state.Version)
+		}
+	}
+	if state.Namespaces == nil {
+		state.Namespaces = make(map[string]*namespaceDeletions)
+	}
+	return state, nil
+}
+
+// saveDeletionState replaces the circuit breaker state file, through a
+// temporary file so that it is never left partially written.
+func saveDeletionState(path string, state *deletionState) error {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error marshalling state to json: %s", err)
+	}
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(stateBytes); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// withStateLock calls fn holding the lock of the state file, a lock file
+// created next to it, waiting for the lock until the context is done.
+func withStateLock(ctx context.Context, path string, fn func() error) error {
+	lockPath := path + ".lock"
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+		if err == nil {
+			file.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			log.Printf("Removing stale lock %s\n", lockPath)
+			_ = removeIfExists(lockPath)
+			continue
+		}
+
+		timer := time.NewTimer(50 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("waiting for lock %s: %s", lockPath, ctx.Err())
+		case <-timer.C:
+		}
+	}
+	defer removeIfExists(lockPath)
+	return fn()
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/httpclient"
+	"github.com/sensu/sensu-ec2-handler/aws"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// evaluateDeregistration decides whether the entity must be deregistered from
+// Sensu based on the status of its instance, and reports the decision. The
+// event is nil outside of the handler. The instance is only described when the
+// decision needs it. The entity is kept when its instance has the protection
+// tag.
+func evaluateDeregistration(ctx context.Context, awsHandler *aws.Handler, event *corev2.Event, entity *corev2.Entity, instanceStatus *aws.InstanceStatus) (*deregistrationReport, error) {
+	report, err := decideDeregistration(ctx, awsHandler, event, entity, instanceStatus)
+	if err != nil || !report.Deregister {
+		return report, err
+	}
+
+	protection, err := instanceProtection(ctx, awsHandler, instanceStatus, report)
+	if err != nil {
+		return nil, err
+	}
+	if len(protection) > 0 {
+		log.Printf("Protected by the %s, not deregistering '%s' entity from Sensu for '%s' AWS instance", protection, entity.Name, instanceStatus.InstanceID)
+		report.Deregister = false
+		report.Action = ""
+		report.Protected = protection
+	}
+	return report, nil
+}
+
+// decideDeregistration takes the deregistration decision from the policy
+// expression, or from the built-in rules.
+func decideDeregistration(ctx context.Context, awsHandler *aws.Handler, event *corev2.Event, entity *corev2.Entity, instanceStatus *aws.InstanceStatus) (*deregistrationReport, error) {
+	report := newDeregistrationReport(entity, instanceStatus)
+
+	// The policy expression replaces the built-in rules
+	if deregistrationPolicy != nil {
+		return evaluatePolicy(ctx, awsHandler, event, entity, instanceStatus, report)
+	}
+
+	// The Auto Scaling lifecycle state overrides the EC2 state when it matches
+	// the configured patterns
+	if lifecycleStateMatters(report) {
+		lifecycleState, err := awsHandler.GetLifecycleStateWithContext(ctx, instanceStatus)
+		if err != nil {
+			return nil, phaseError(ctx, "getting the auto scaling lifecycle state", fmt.Errorf("could not get auto scaling lifecycle state: %s", err))
+		}
+		report.LifecycleState = lifecycleState
+		if aws.MatchLifecycleState(awsConfig.AutoScalingKeepStatesList, lifecycleState) {
+			log.Printf("'%s' is a kept lifecycle state, not deregistering '%s' entity from Sensu for '%s' AWS instance", lifecycleState,
+				entity.Name, instanceStatus.InstanceID)
+			report.Deregister = false
+			return report, nil
+		}
+		if aws.MatchLifecycleState(awsConfig.AutoScalingDeregisterStatesList, lifecycleState) {
+			report.Deregister = true
+			if err := setAction(ctx, awsHandler, instanceStatus, report); err != nil {
+				return nil, err
+			}
+			log.Printf("'%s' is a deregistered lifecycle state, deregistering (%s) '%s' entity from Sensu for '%s' AWS instance", lifecycleState,
+				report.Action, entity.Name, instanceStatus.InstanceID)
+			return report, nil
+		}
+	}
+
+	// Instances in an allowed state are deregistered when their tags match
+	if !report.Deregister && len(awsConfig.TagRulesList) > 0 && instanceStatus.State != aws.InstanceStateNotFound {
+		instance, err := describeInstance(ctx, awsHandler, instanceStatus, report)
+		if err != nil {
+			return nil, err
+		}
+		for _, tagRule := range awsConfig.TagRulesList {
+			if tagRule.Match(instance.Tags) {
+				report.TagRule = tagRule.String()
+				report.Deregister = true
+				if err := setAction(ctx, awsHandler, instanceStatus, report); err != nil {
+					return nil, err
+				}
+				log.Printf("'%s' tag rule matched, deregistering (%s) '%s' entity from Sensu for '%s' AWS instance", tagRule,
+					report.Action, entity.Name, instanceStatus.InstanceID)
+				return report, nil
+			}
+		}
+	}
+
+	if !report.Deregister {
+		log.Printf("'%s' is a valid instance state, not deregistering '%s' entity from Sensu for '%s' AWS instance", instanceStatus.State,
+			entity.Name, instanceStatus.InstanceID)
+		return report, nil
+	}
+
+	// Wait for the instance to be in the state long enough
+	if minAge := awsConfig.InstanceStateMinAgesMap[instanceStatus.State]; minAge > 0 {
+		report.MinStateAge = minAge.String()
+		instance, err := describeInstance(ctx, awsHandler, instanceStatus, report)
+		if err != nil {
+			return nil, err
+		}
+		transitionTime := instance.StateTransitionTime()
+		if transitionTime.IsZero() {
+			log.Printf("Unknown '%s' state transition time, not deregistering '%s' entity from Sensu for '%s' AWS instance", instanceStatus.State,
+				entity.Name, instanceStatus.InstanceID)
+			report.Deregister = false
+			return report, nil
+		}
+		report.StateTransitionTime = &transitionTime
+		if stateAge := time.Since(transitionTime); stateAge < minAge {
+			log.Printf("'%s' instance state for %s, less than %s, not deregistering '%s' entity from Sensu for '%s' AWS instance", instanceStatus.State,
+				stateAge.Round(time.Second), minAge, entity.Name, instanceStatus.InstanceID)
+			report.Deregister = false
+			return report, nil
+		}
+	}
+
+	if err := setAction(ctx, awsHandler, instanceStatus, report); err != nil {
+		return nil, err
+	}
+	log.Printf("'%s' is not a valid instance state, deregistering (%s) '%s' entity from Sensu for '%s' AWS instance", instanceStatus.State,
+		report.Action, entity.Name, instanceStatus.InstanceID)
+	return report, nil
+}
+
+// evaluatePolicy decides whether the entity must be deregistered from Sensu
+// with the policy expression.
+func evaluatePolicy(ctx context.Context, awsHandler *aws.Handler, event *corev2.Event, entity *corev2.Entity, instanceStatus *aws.InstanceStatus, report *deregistrationReport) (*deregistrationReport, error) {
+	var description *aws.Instance
+	if instanceStatus.State != aws.InstanceStateNotFound {
+		var err error
+		description, err = describeInstance(ctx, awsHandler, instanceStatus, report)
+		if err != nil {
+			return nil, err
+		}
+	}
+	instance := newPolicyInstance(instanceStatus, description)
+	if instance.StateTransitionTime != nil {
+		report.StateTransitionTime = instance.StateTransitionTime
+	}
+
+	result, err := deregistrationPolicy.evaluate(ctx, event, entity, instance)
+	if err != nil {
+		return nil, phaseError(ctx, "evaluating the policy", fmt.Errorf("could not evaluate policy: %s", err))
+	}
+	report.Policy = true
+	switch result {
+	case actionKeep:
+		report.Deregister = false
+		log.Printf("Policy returned keep, not deregistering '%s' entity from Sensu for '%s' AWS instance", entity.Name, instanceStatus.InstanceID)
+		return report, nil
+	case actionDelete, actionSilence:
+		report.Deregister = true
+		report.Action = result
+	default:
+		report.Deregister = true
+		if err := setAction(ctx, awsHandler, instanceStatus, report); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Policy matched, deregistering (%s) '%s' entity from Sensu for '%s' AWS instance", report.Action, entity.Name, instanceStatus.InstanceID)
+	return report, nil
+}
+
+// describeInstance returns the description of the instance of the report,
+// describing the instance if it was not described yet.
+func describeInstance(ctx context.Context, awsHandler *aws.Handler, instanceStatus *aws.InstanceStatus, report *deregistrationReport) (*aws.Instance, error) {
+	if report.Instance != nil {
+		return report.Instance, nil
+	}
+	instance, err := awsHandler.GetInstanceWithContext(ctx, instanceStatus)
+	if err != nil {
+		return nil, phaseError(ctx, "describing the instance", fmt.Errorf("could not describe instance: %s", err))
+	}
+	log.Printf("Instance type: %s, lifecycle: %s, state reason: %s, state transition reason: %s", instance.InstanceType,
+		instance.Lifecycle(), instance.StateReasonCode, instance.StateTransitionReason)
+	report.Instance = instance
+	return instance, nil
+}
+
+// lifecycleStateMatters returns true if the Auto Scaling lifecycle state may
+// change the decision taken from the EC2 state of the report.
+func lifecycleStateMatters(report *deregistrationReport) bool {
+	if report.InstanceState == aws.InstanceStateNotFound {
+		return false
+	}
+	if report.Deregister {
+		return len(awsConfig.AutoScalingKeepStatesList) > 0
+	}
+	return len(awsConfig.AutoScalingDeregisterStatesList) > 0
+}
+
+// setAction sets the action taken on the entity of the report, selected by
+// the state reason category of the instance, or else by the instance state.
+// The instance is described if its state reason matters and the report does
+// not have its description yet.
+func setAction(ctx context.Context, awsHandler *aws.Handler, instanceStatus *aws.InstanceStatus, report *deregistrationReport) error {
+	if stateReasonMatters() && instanceStatus.State != aws.InstanceStateNotFound {
+		if _, err := describeInstance(ctx, awsHandler, instanceStatus, report); err != nil {
+			return err
+		}
+	}
+	report.Action = actionDelete
+	if action, ok := instanceStateActionsMap[report.InstanceState]; ok {
+		report.Action = action
+	}
+	if action, ok := stateReasonActionsMap[report.stateReasonCategory()]; ok {
+		report.Action = action
+	}
+	return nil
+}
+
+// stateReasonMatters returns true if the state reason of the instance selects
+// the action or is part of the deregistration event.
+func stateReasonMatters() bool {
+	return len(stateReasonActionsMap) > 0 || len(deregistrationEventEntity) > 0
+}
+
+// executeAction takes the action of the report on the entity, and records it
+// with a deregistration event if enabled. The events of deleted entities are
+// deleted after them when enabled. Entities are archived right before being
+// deleted when enabled. Deletions are aborted when the entity
+// was seen after staleSince, a unix timestamp, or the event of one of the
+// trigger checks is now OK, and refused once the maximum number of deletions is
+// reached.
+func executeAction(ctx context.Context, client *httpclient.CoreClient, entity *corev2.Entity, report *deregistrationReport, triggerChecks []string, staleSince int64) error {
+	var err, eventsErr error
+	switch report.Action {
+	case actionSilence:
+		reason := silenceReason
+		if len(reason) == 0 {
+			reason = fmt.Sprintf("EC2 instance %s is %s", report.InstanceID, report.InstanceState)
+			if report.Instance != nil && len(report.Instance.StateReasonCode) > 0 {
+				reason += fmt.Sprintf(" (%s)", report.Instance.StateReasonCode)
+			}
+		}
+		var silenced bool
+		silenced, err = silenceEntity(ctx, client, entity, reason)
+		if err == nil && !silenced {
+			report.Unchanged = "already silenced"
+		}
+	default:
+		var current *corev2.Entity
+		var reason string
+		current, reason, err = verifyStale(ctx, client, entity, triggerChecks, staleSince)
+		if err == nil && len(reason) > 0 {
+			log.Printf("Entity %s, aborting the deletion of '%s' entity from Sensu for '%s' AWS instance", reason, entity.Name, report.InstanceID)
+			report.Deregister = false
+			report.Action = ""
+			report.Aborted = reason
+			return nil
+		}
+		if err == nil {
+			err = reserveDeletion(ctx, client, entity)
+		}
+		if err == nil && archiveTarget != nil && current != nil {
+			report.Archive, err = archiveEntity(ctx, current)
+			if err != nil {
+				err = fmt.Errorf("could not archive entity: %s", err)
+			}
+		}
+		if err == nil {
+			var deleted bool
+			deleted, err = deleteEntity(ctx, client, entity)
+			if err == nil && !deleted {
+				report.Unchanged = "already deleted"
+			}
+		}
+		if err == nil && deletesEntityEvents(entity) {
+			eventsErr = deleteEntityEvents(ctx, client, entity, report)
+		}
+	}
+	if err != nil {
+		return phaseError(ctx, fmt.Sprintf("taking the %s action", report.Action), err)
+	}
+	if postsDeregistrationEvent(report) {
+		if err := postDeregistrationEvent(ctx, client, entity, report); err != nil {
+			return phaseError(ctx, "posting the deregistration event", err)
+		}
+	}
+	return phaseError(ctx, "deleting the events of the entity", eventsErr)
+}
+
+// verifyStale fetches the entity and the events of its trigger checks again
+// right before deleting it, since the agent may have reconnected, or a check
+// may have recovered, while the handler was running. The entity fetched, nil if it
+// no longer exists, is returned along with the reason why the entity is no
+// longer stale, empty if it still is.
+func verifyStale(ctx context.Context, client *httpclient.CoreClient, entity *corev2.Entity, triggerChecks []string, staleSince int64) (*corev2.Entity, string, error) {
+	current, err := getEntity(ctx, client, entity.Namespace, entity.Name)
+	if err != nil {
+		return nil, "", phaseError(ctx, "verifying the entity is stale", fmt.Errorf("could not get entity: %s", err))
+	}
+	if current != nil && staleSince > 0 && current.LastSeen > staleSince {
+		return current, fmt.Sprintf("seen at %s, after %s", time.Unix(current.LastSeen, 0).UTC().Format(time.RFC3339),
+			time.Unix(staleSince, 0).UTC().Format(time.RFC3339)), nil
+	}
+
+	for _, triggerCheck := range triggerChecks {
+		triggerEvent, err := getEvent(ctx, client, entity.Namespace, entity.Name, triggerCheck)
+		if err != nil {
+			return nil, "", phaseError(ctx, "verifying the entity is stale", fmt.Errorf("could not get %s event: %s", triggerCheck, err))
+		}
+		if triggerEvent != nil && triggerEvent.Check != nil && triggerEvent.Check.Status == 0 {
+			return current, fmt.Sprintf("%s status is OK", triggerCheck), nil
+		}
+	}
+	return current, "", nil
+}
+
+// runContext returns the context of a handler or reconcile run, which has a
+// deadline when a timeout is configured.
+func runContext() (context.Context, context.CancelFunc) {
+	if awsConfig.Timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(awsConfig.Timeout)*time.Second)
+}
+
+// phaseError states which phase of the run timed out when the error was
+// caused by the deadline of the context. Other errors are returned as is.
+func phaseError(ctx context.Context, phase string, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	return fmt.Errorf("timed out after %ds %s: %s", awsConfig.Timeout, phase, err)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/sensu-community/sensu-plugin-sdk/httpclient"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// eventDeletion is the outcome of the deletion of an event of a deleted entity.
+type eventDeletion struct {
+	Check   string `json:"check"`
+	Deleted bool   `json:"deleted"`
+	Error   string `json:"error,omitempty"`
+}
+
+// deletesEntityEvents returns true if the events of the entity are deleted
+// along with it.
+func deletesEntityEvents(entity *corev2.Entity) bool {
+	return deleteEvents || (deleteProxyEvents && entity.EntityClass == corev2.EntityProxyClass)
+}
+
+// deleteEntityEvents deletes the events of the entity whose check is selected
+// by the include and exclude patterns, recording the outcome of each deletion
+// in the report. A failed deletion does not stop the others.
+func deleteEntityEvents(ctx context.Context, client *httpclient.CoreClient, entity *corev2.Entity, report *deregistrationReport) error {
+	events, err := listEntityEvents(ctx, client, entity)
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	for _, event := range events {
+		if event.Check == nil || !eventDeletionSelected(event.Check.Name) {
+			continue
+		}
+		deletion := &eventDeletion{Check: event.Check.Name, Deleted: true}
+		if err := deleteEvent(ctx, client, entity, event.Check.Name); err != nil {
+			log.Printf("Could not delete event (%s/%s/%s): %s", entity.Namespace, entity.Name, event.Check.Name, err)
+			deletion.Deleted = false
+			deletion.Error = err.Error()
+			failures++
+		}
+		report.Events = append(report.Events, deletion)
+	}
+	if failures > 0 {
+		return fmt.Errorf("could not delete %d of the %d events of entity %s/%s", failures, len(report.Events), entity.Namespace, entity.Name)
+	}
+	return nil
+}
+
+// eventDeletionSelected returns true if the events of the check are deleted
+// along with their entity.
+func eventDeletionSelected(checkName string) bool {
+	if len(deleteEventsIncludeList) > 0 && !matchCheckPatterns(deleteEventsIncludeList, checkName) {
+		return false
+	}
+	return !matchCheckPatterns(deleteEventsExcludeList, checkName)
+}
+
+// matchCheckPatterns returns true if the check name matches one of the
+// patterns.
+func matchCheckPatterns(patterns []string, checkName string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, checkName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCheckPatterns parses comma separated check name patterns.
+func parseCheckPatterns(patterns string) ([]string, error) {
+	parsed := []string{}
+	for _, pattern := range strings.Split(patterns, ",") {
+		trimmedPattern := strings.TrimSpace(pattern)
+		if len(trimmedPattern) == 0 {
+			continue
+		}
+		if _, err := path.Match(trimmedPattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid check name pattern %s: %s", trimmedPattern, err)
+		}
+		parsed = append(parsed, trimmedPattern)
+	}
+	return parsed, nil
+}
@@ -2,23 +2,29 @@ package main
 
 import (
 	"context"
-	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/arn"
-	"github.com/sensu-community/sensu-plugin-sdk/httpclient"
 	"github.com/sensu-community/sensu-plugin-sdk/sensu"
 	"github.com/sensu/sensu-ec2-handler/aws"
+	"github.com/sensu/sensu-ec2-handler/retry"
 	corev2 "github.com/sensu/sensu-go/api/core/v2"
 )
 
 const (
 	keepAliveEventName = "keepalive"
+
+	actionDelete  = "delete"
+	actionSilence = "silence"
 )
 
 var (
@@ -31,11 +37,75 @@ var (
 		},
 	}
 
-	awsInstanceIDLabel = ""
+	awsInstanceIDLabel       = ""
+	awsRegionLabel           = ""
+	awsAvailabilityZoneLabel = ""
+	awsAccountIDLabel        = ""
+	awsAccountsFile          = ""
+	awsProtectionTag         = ""
+	protectionLabel          = ""
+
+	sensuAPIURL     string
+	sensuAPIKey     string
+	sensuCACert     string
+	sensuClientCert string
+	sensuClientKey  string
+
+	dryRun bool
+
+	triggerChecks     string
+	triggerChecksList []string
+	deleteProxyEvents bool
+
+	deleteEvents            bool
+	deleteEventsInclude     string
+	deleteEventsIncludeList []string
+	deleteEventsExclude     string
+	deleteEventsExcludeList []string
+
+	archive              string
+	archiveFormat        string
+	archiveAuthorization string
+	archiveTarget        *archiveDestination
+
+	auditLog             string
+	auditLogDestinations []string
+	auditLogMaxSize      int
+	auditLogMaxBackups   int
+
+	deregistrationEventEntity       string
+	deregistrationEventHandlers     string
+	deregistrationEventHandlersList []string
+	deregistrationEventStatus       int
 
-	sensuAPIURL string
-	sensuAPIKey string
-	sensuCACert string
+	deregistrationEventReasons              string
+	deregistrationEventReasonsList          []string
+	deregistrationEventReasonAnnotations    string
+	deregistrationEventReasonAnnotationsMap map[string]map[string]string
+
+	maxDeletions               int
+	maxDeletionsWindow         string
+	maxDeletionsWindowDuration time.Duration
+	maxDeletionsStateFile      string
+	maxDeletionsEventEntity    string
+
+	retryMaxAttempts int
+	retryBaseDelay   string
+	retryMaxDelay    string
+
+	instanceStateActions    string
+	instanceStateActionsMap map[string]string
+	stateReasonActions      string
+	stateReasonActionsMap   map[string]string
+	silenceExpire           string
+	silenceExpireDuration   time.Duration
+	silenceReason           string
+
+	policy               string
+	deregistrationPolicy *decisionPolicy
+
+	// awsClientFactories create the AWS clients used by the aws handler
+	awsClientFactories = aws.DefaultClientFactories()
 
 	options = []*sensu.PluginConfigOption{
 		{
@@ -85,6 +155,30 @@ var (
 			Usage:     "The AWS region",
 			Value:     &awsConfig.AwsRegion,
 		},
+		{
+			Path:     "aws-regions",
+			Env:      "AWS_REGIONS",
+			Argument: "aws-regions",
+			Default:  "",
+			Usage:    "The AWS regions to search for instances not found in their region, defaults to all enabled regions",
+			Value:    &awsConfig.AwsRegions,
+		},
+		{
+			Path:     "aws-region-label",
+			Env:      "AWS_REGION_LABEL",
+			Argument: "aws-region-label",
+			Default:  "aws-region",
+			Usage:    "The entity label containing the AWS region",
+			Value:    &awsRegionLabel,
+		},
+		{
+			Path:     "aws-availability-zone-label",
+			Env:      "AWS_AVAILABILITY_ZONE_LABEL",
+			Argument: "aws-availability-zone-label",
+			Default:  "aws-availability-zone",
+			Usage:    "The entity label containing the AWS availability zone",
+			Value:    &awsAvailabilityZoneLabel,
+		},
 		{
 			Path:      "aws-allowed-instance-states",
 			Env:       "AWS_ALLOWED_INSTANCE_STATES",
@@ -94,15 +188,200 @@ var (
 			Usage:     "The EC2 instance states allowed",
 			Value:     &awsConfig.AllowedInstanceStates,
 		},
+		{
+			Path:     "aws-autoscaling-keep-states",
+			Env:      "AWS_AUTOSCALING_KEEP_STATES",
+			Argument: "aws-autoscaling-keep-states",
+			Default:  "",
+			Usage:    "The Auto Scaling lifecycle states keeping the entity regardless of the EC2 instance state, for example Standby,Pending*",
+			Value:    &awsConfig.AutoScalingKeepStates,
+		},
+		{
+			Path:     "aws-autoscaling-deregister-states",
+			Env:      "AWS_AUTOSCALING_DEREGISTER_STATES",
+			Argument: "aws-autoscaling-deregister-states",
+			Default:  "",
+			Usage:    "The Auto Scaling lifecycle states deregistering the entity regardless of the EC2 instance state, for example Terminating*",
+			Value:    &awsConfig.AutoScalingDeregisterStates,
+		},
+		{
+			Path:     "aws-tag-rules",
+			Env:      "AWS_TAG_RULES",
+			Argument: "aws-tag-rules",
+			Default:  "",
+			Usage:    "The rules on the EC2 instance tags deregistering the entity regardless of the instance state, for example monitoring=disabled,decommissioned~^(true|yes)$,!owner",
+			Value:    &awsConfig.TagRules,
+		},
+		{
+			Path:     "trigger-checks",
+			Env:      "TRIGGER_CHECKS",
+			Argument: "trigger-checks",
+			Default:  keepAliveEventName,
+			Usage:    "The check names whose events trigger the handler, comma separated",
+			Value:    &triggerChecks,
+		},
+		{
+			Path:     "delete-proxy-events",
+			Env:      "DELETE_PROXY_EVENTS",
+			Argument: "delete-proxy-events",
+			Default:  false,
+			Usage:    "Delete the events of proxy entities after deleting them",
+			Value:    &deleteProxyEvents,
+		},
+		{
+			Path:     "delete-events",
+			Env:      "DELETE_EVENTS",
+			Argument: "delete-events",
+			Default:  false,
+			Usage:    "Delete the events of all the entities after deleting them",
+			Value:    &deleteEvents,
+		},
+		{
+			Path:     "delete-events-include",
+			Env:      "DELETE_EVENTS_INCLUDE",
+			Argument: "delete-events-include",
+			Default:  "",
+			Usage:    "The check name patterns of the events deleted with their entity, comma separated, where * matches any characters (defaults to all the checks)",
+			Value:    &deleteEventsInclude,
+		},
+		{
+			Path:     "delete-events-exclude",
+			Env:      "DELETE_EVENTS_EXCLUDE",
+			Argument: "delete-events-exclude",
+			Default:  "",
+			Usage:    "The check name patterns of the events kept when deleting their entity, comma separated",
+			Value:    &deleteEventsExclude,
+		},
+		{
+			Path:     "archive",
+			Env:      "ARCHIVE",
+			Argument: "archive",
+			Default:  "",
+			Usage:    "The destination of the definitions of the entities archived before deleting them, a local directory, an s3://bucket/prefix URL or an http(s) URL (defaults to no archive)",
+			Value:    &archive,
+		},
+		{
+			Path:     "archive-format",
+			Env:      "ARCHIVE_FORMAT",
+			Argument: "archive-format",
+			Default:  archiveFormatJSON,
+			Usage:    "The format of the archived entity definitions, json or yaml",
+			Value:    &archiveFormat,
+		},
+		{
+			Path:     "archive-s3-endpoint",
+			Env:      "ARCHIVE_S3_ENDPOINT",
+			Argument: "archive-s3-endpoint",
+			Default:  "",
+			Usage:    "The endpoint of an S3 compatible storage used instead of AWS S3 for s3 archives",
+			Value:    &awsConfig.S3Endpoint,
+		},
+		{
+			Path:     "archive-authorization",
+			Env:      "ARCHIVE_AUTHORIZATION",
+			Argument: "archive-authorization",
+			Default:  "",
+			Secret:   true,
+			Usage:    "The Authorization header of the requests uploading to an http(s) archive",
+			Value:    &archiveAuthorization,
+		},
+		{
+			Path:     "protection-label",
+			Env:      "PROTECTION_LABEL",
+			Argument: "protection-label",
+			Default:  "sensu.io/plugins/sensu-ec2-handler/protected",
+			Usage:    "The entity label or annotation protecting the entity from deregistration when set to true, empty disables it",
+			Value:    &protectionLabel,
+		},
+		{
+			Path:     "aws-protection-tag",
+			Env:      "AWS_PROTECTION_TAG",
+			Argument: "aws-protection-tag",
+			Default:  "",
+			Usage:    "The EC2 instance tag protecting the entity from deregistration when set to true, for example sensu-protected (defaults to no tag)",
+			Value:    &awsProtectionTag,
+		},
+		{
+			Path:     "policy",
+			Env:      "POLICY",
+			Argument: "policy",
+			Default:  "",
+			Usage:    "The JavaScript policy expression deciding the action taken on the entity, returning delete, silence or keep, it replaces the built-in deregistration rules",
+			Value:    &policy,
+		},
+		{
+			Path:     "aws-instance-state-actions",
+			Env:      "AWS_INSTANCE_STATE_ACTIONS",
+			Argument: "aws-instance-state-actions",
+			Default:  "",
+			Usage:    "The action taken on the entity per EC2 instance state, delete or silence, for example terminated=delete,stopped=silence (defaults to delete)",
+			Value:    &instanceStateActions,
+		},
+		{
+			Path:     "aws-state-reason-actions",
+			Env:      "AWS_STATE_REASON_ACTIONS",
+			Argument: "aws-state-reason-actions",
+			Default:  "",
+			Usage:    "The action taken on the entity per EC2 state reason category, delete or silence, overriding the instance state action, for example spot-interruption=silence,user-initiated=delete",
+			Value:    &stateReasonActions,
+		},
+		{
+			Path:     "silence-expire",
+			Env:      "SILENCE_EXPIRE",
+			Argument: "silence-expire",
+			Default:  "",
+			Usage:    "The expiry of the silenced entries created by the silence action, for example 72h (defaults to no expiry)",
+			Value:    &silenceExpire,
+		},
+		{
+			Path:     "silence-reason",
+			Env:      "SILENCE_REASON",
+			Argument: "silence-reason",
+			Default:  "",
+			Usage:    "The reason of the silenced entries created by the silence action (defaults to the EC2 instance state)",
+			Value:    &silenceReason,
+		},
+		{
+			Path:     "aws-instance-state-min-ages",
+			Env:      "AWS_INSTANCE_STATE_MIN_AGES",
+			Argument: "aws-instance-state-min-ages",
+			Default:  "",
+			Usage:    "The minimum time an EC2 instance must be in a state before being deregistered, for example stopped=24h",
+			Value:    &awsConfig.InstanceStateMinAges,
+		},
 		{
 			Path:      "timeout",
 			Env:       "TIMEOUT",
 			Argument:  "timeout",
 			Shorthand: "t",
 			Default:   uint64(10),
-			Usage:     "The plugin timeout",
+			Usage:     "The plugin timeout in seconds, a deadline for all the AWS and Sensu API calls of a run, 0 disables it",
 			Value:     &awsConfig.Timeout,
 		},
+		{
+			Path:     "retry-max-attempts",
+			Env:      "RETRY_MAX_ATTEMPTS",
+			Argument: "retry-max-attempts",
+			Default:  4,
+			Usage:    "The maximum number of attempts of the AWS and Sensu API calls failing with throttling or server errors",
+			Value:    &retryMaxAttempts,
+		},
+		{
+			Path:     "retry-base-delay",
+			Env:      "RETRY_BASE_DELAY",
+			Argument: "retry-base-delay",
+			Default:  "250ms",
+			Usage:    "The base delay of the exponential backoff between attempts",
+			Value:    &retryBaseDelay,
+		},
+		{
+			Path:     "retry-max-delay",
+			Env:      "RETRY_MAX_DELAY",
+			Argument: "retry-max-delay",
+			Default:  "5s",
+			Usage:    "The maximum delay between attempts",
+			Value:    &retryMaxDelay,
+		},
 		{
 			Path:      "sensu-api-url",
 			Env:       "SENSU_API_URL",
@@ -126,9 +405,26 @@ var (
 			Env:       "SENSU_CA_CERT",
 			Argument:  "sensu-ca-cert",
 			Shorthand: "c",
-			Usage:     "The Sensu Go CA Certificate",
+			Usage:     "The Sensu Go CA Certificate, a PEM bundle or DER file, or inline PEM content",
 			Value:     &sensuCACert,
 		},
+		{
+			Path:     "sensu-client-cert",
+			Env:      "SENSU_CLIENT_CERT",
+			Argument: "sensu-client-cert",
+			Default:  "",
+			Usage:    "The client certificate for mutual TLS with the Sensu API, a PEM file or inline PEM content",
+			Value:    &sensuClientCert,
+		},
+		{
+			Path:     "sensu-client-key",
+			Env:      "SENSU_CLIENT_KEY",
+			Argument: "sensu-client-key",
+			Default:  "",
+			Secret:   true,
+			Usage:    "The client key for mutual TLS with the Sensu API, a PEM file or inline PEM content",
+			Value:    &sensuClientKey,
+		},
 		{
 			Path:      "aws-assume-role-arn",
 			Env:       "AWS_ASSUME_ROLE_ARN",
@@ -137,19 +433,177 @@ var (
 			Usage:     "The AWS IAM Role to assume",
 			Value:     &awsConfig.AssumeRoleArn,
 		},
+		{
+			Path:     "aws-assume-role-template",
+			Env:      "AWS_ASSUME_ROLE_TEMPLATE",
+			Argument: "aws-assume-role-template",
+			Default:  "",
+			Usage:    "The template of the AWS IAM Role to assume in an account, for example arn:aws:iam::{{.AccountID}}:role/sensu",
+			Value:    &awsConfig.AssumeRoleTemplate,
+		},
+		{
+			Path:     "aws-accounts",
+			Env:      "AWS_ACCOUNTS",
+			Argument: "aws-accounts",
+			Default:  "",
+			Usage:    "The AWS account IDs to search for instances of unknown account",
+			Value:    &awsConfig.AwsAccounts,
+		},
+		{
+			Path:     "aws-accounts-file",
+			Env:      "AWS_ACCOUNTS_FILE",
+			Argument: "aws-accounts-file",
+			Default:  "",
+			Usage:    "The JSON file mapping AWS account IDs to the AWS IAM Role to assume in them",
+			Value:    &awsAccountsFile,
+		},
+		{
+			Path:     "aws-account-id-label",
+			Env:      "AWS_ACCOUNT_ID_LABEL",
+			Argument: "aws-account-id-label",
+			Default:  "aws-account-id",
+			Usage:    "The entity label containing the AWS account ID",
+			Value:    &awsAccountIDLabel,
+		},
+		{
+			Path:     "dry-run",
+			Env:      "DRY_RUN",
+			Argument: "dry-run",
+			Default:  false,
+			Usage:    "Report the deregistration decision without deleting the entity",
+			Value:    &dryRun,
+		},
+		{
+			Path:     "audit-log",
+			Env:      "AUDIT_LOG",
+			Argument: "audit-log",
+			Default:  "",
+			Usage:    "The destinations of the JSON Lines audit log of the deregistration decisions, stdout or a file path, comma separated",
+			Value:    &auditLog,
+		},
+		{
+			Path:     "audit-log-max-size",
+			Env:      "AUDIT_LOG_MAX_SIZE",
+			Argument: "audit-log-max-size",
+			Default:  10,
+			Usage:    "The size in megabytes after which the audit log file is rotated, 0 disables the rotation",
+			Value:    &auditLogMaxSize,
+		},
+		{
+			Path:     "audit-log-max-backups",
+			Env:      "AUDIT_LOG_MAX_BACKUPS",
+			Argument: "audit-log-max-backups",
+			Default:  5,
+			Usage:    "The number of rotated audit log files to keep",
+			Value:    &auditLogMaxBackups,
+		},
+		{
+			Path:     "deregistration-event-entity",
+			Env:      "DEREGISTRATION_EVENT_ENTITY",
+			Argument: "deregistration-event-entity",
+			Default:  "",
+			Usage:    "The proxy entity of the event posted after deregistering an entity, for example ec2-deregistrations (defaults to no event)",
+			Value:    &deregistrationEventEntity,
+		},
+		{
+			Path:     "deregistration-event-handlers",
+			Env:      "DEREGISTRATION_EVENT_HANDLERS",
+			Argument: "deregistration-event-handlers",
+			Default:  "",
+			Usage:    "The handlers of the event posted after deregistering an entity, comma separated",
+			Value:    &deregistrationEventHandlers,
+		},
+		{
+			Path:     "deregistration-event-status",
+			Env:      "DEREGISTRATION_EVENT_STATUS",
+			Argument: "deregistration-event-status",
+			Default:  1,
+			Usage:    "The check status of the event posted after deregistering an entity",
+			Value:    &deregistrationEventStatus,
+		},
+		{
+			Path:     "deregistration-event-reasons",
+			Env:      "DEREGISTRATION_EVENT_REASONS",
+			Argument: "deregistration-event-reasons",
+			Default:  "",
+			Usage:    "The EC2 state reason categories whose deregistrations post the event, comma separated, for example spot-interruption,system-error (defaults to all)",
+			Value:    &deregistrationEventReasons,
+		},
+		{
+			Path:     "deregistration-event-reason-annotations",
+			Env:      "DEREGISTRATION_EVENT_REASON_ANNOTATIONS",
+			Argument: "deregistration-event-reason-annotations",
+			Default:  "",
+			Usage:    "The annotations of the event posted after deregistering an entity per EC2 state reason category, comma separated, for example spot-interruption:team=capacity",
+			Value:    &deregistrationEventReasonAnnotations,
+		},
+		{
+			Path:     "max-deletions",
+			Env:      "MAX_DELETIONS",
+			Argument: "max-deletions",
+			Default:  0,
+			Usage:    "The maximum number of entities deleted per namespace within the window, further deletions are refused, 0 disables the limit",
+			Value:    &maxDeletions,
+		},
+		{
+			Path:     "max-deletions-window",
+			Env:      "MAX_DELETIONS_WINDOW",
+			Argument: "max-deletions-window",
+			Default:  "1h",
+			Usage:    "The rolling window of the maximum number of deletions",
+			Value:    &maxDeletionsWindow,
+		},
+		{
+			Path:     "max-deletions-state-file",
+			Env:      "MAX_DELETIONS_STATE_FILE",
+			Argument: "max-deletions-state-file",
+			Default:  "/var/cache/sensu/sensu-backend/sensu-ec2-handler-deletions.json",
+			Usage:    "The file recording the recent deletions, shared by all the handler runs",
+			Value:    &maxDeletionsStateFile,
+		},
+		{
+			Path:     "max-deletions-event-entity",
+			Env:      "MAX_DELETIONS_EVENT_ENTITY",
+			Argument: "max-deletions-event-entity",
+			Default:  "sensu-ec2-handler",
+			Usage:    "The proxy entity of the alert event posted when the maximum number of deletions is reached",
+			Value:    &maxDeletionsEventEntity,
+		},
 	}
 
 	validInstanceStates = map[string]bool{
-		"pending":       true,
-		"running":       true,
-		"stopping":      true,
-		"stopped":       true,
-		"shutting-down": true,
-		"terminated":    true,
+		"pending":                 true,
+		"running":                 true,
+		"stopping":                true,
+		"stopped":                 true,
+		"shutting-down":           true,
+		"terminated":              true,
+		aws.InstanceStateNotFound: true,
 	}
+
+	// awsRegionRegexp matches an AWS region, or the region prefix of an
+	// availability zone
+	awsRegionRegexp = regexp.MustCompile(`^[a-z]{2}(-gov)?-[a-z]+-[0-9]+`)
+
+	// ec2HostnameRegexp matches the default private hostnames of EC2 instances
+	ec2HostnameRegexp = regexp.MustCompile(`\.([a-z]{2}(-gov)?-[a-z]+-[0-9]+)\.compute\.internal$`)
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == reconcileCommand {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		reconcile := sensu.NewGoCheck(&reconcileConfig, reconcileOptions(), checkReconcileArgs, executeReconcile, false)
+		reconcile.Execute()
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == restoreCommand {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		restore := sensu.NewGoCheck(&restoreConfig, restoreOptions(), checkRestoreArgs, executeRestore, false)
+		restore.Execute()
+		return
+	}
+
 	goHandler := sensu.NewGoHandler(&awsConfig.PluginConfig, options, checkArgs, executeHandler)
 	goHandler.Execute()
 }
@@ -168,6 +622,13 @@ func checkArgs(event *corev2.Event) error {
 	if len(awsConfig.AwsInstanceID) == 0 {
 		return fmt.Errorf("aws-instance-id must contain a value")
 	}
+
+	return validateConfig()
+}
+
+// validateConfig validates the configuration shared by the handler and the
+// reconcile command.
+func validateConfig() error {
 	if len(awsConfig.AllowedInstanceStates) == 0 {
 		return fmt.Errorf("allowed-instance-states must contain at least one value")
 	}
@@ -181,6 +642,9 @@ func checkArgs(event *corev2.Event) error {
 	if len(sensuAPIKey) == 0 {
 		return fmt.Errorf("sensu-api-key must contain a value")
 	}
+	if (len(sensuClientCert) == 0) != (len(sensuClientKey) == 0) {
+		return fmt.Errorf("sensu-client-cert and sensu-client-key must be set together")
+	}
 	if len(awsConfig.AssumeRoleArn) > 0 {
 		if !arn.IsARN(awsConfig.AssumeRoleArn) {
 			return fmt.Errorf("aws-assume-role-arn %s is not a valid ARN", awsConfig.AssumeRoleArn)
@@ -200,6 +664,288 @@ func checkArgs(event *corev2.Event) error {
 		}
 	}
 
+	// parse the instance state minimum ages
+	awsConfig.InstanceStateMinAgesMap = make(map[string]time.Duration)
+	for _, stateMinAge := range strings.Split(awsConfig.InstanceStateMinAges, ",") {
+		trimmedStateMinAge := strings.TrimSpace(stateMinAge)
+		if len(trimmedStateMinAge) == 0 {
+			continue
+		}
+		parts := strings.SplitN(trimmedStateMinAge, "=", 2)
+		instanceState := strings.TrimSpace(parts[0])
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid instance state minimum age, expected state=duration: %s", trimmedStateMinAge)
+		}
+		if !validInstanceStates[instanceState] || instanceState == aws.InstanceStateNotFound {
+			return fmt.Errorf("invalid instance state minimum age state: %s", instanceState)
+		}
+		minAge, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("invalid instance state minimum age duration for %s: %s", instanceState, err)
+		}
+		awsConfig.InstanceStateMinAgesMap[instanceState] = minAge
+	}
+
+	// parse the auto scaling lifecycle states
+	awsConfig.AutoScalingKeepStatesList, err = aws.ParseLifecycleStatePatterns(awsConfig.AutoScalingKeepStates)
+	if err != nil {
+		return fmt.Errorf("invalid aws-autoscaling-keep-states: %s", err)
+	}
+	awsConfig.AutoScalingDeregisterStatesList, err = aws.ParseLifecycleStatePatterns(awsConfig.AutoScalingDeregisterStates)
+	if err != nil {
+		return fmt.Errorf("invalid aws-autoscaling-deregister-states: %s", err)
+	}
+
+	// parse the tag rules
+	awsConfig.TagRulesList, err = aws.ParseTagRules(awsConfig.TagRules)
+	if err != nil {
+		return fmt.Errorf("invalid aws-tag-rules: %s", err)
+	}
+
+	// compile the policy expression
+	deregistrationPolicy = nil
+	if len(strings.TrimSpace(policy)) > 0 {
+		deregistrationPolicy, err = parsePolicy(policy)
+		if err != nil {
+			return fmt.Errorf("invalid policy: %s", err)
+		}
+	}
+
+	// parse the instance state actions
+	instanceStateActionsMap = make(map[string]string)
+	for _, stateAction := range strings.Split(instanceStateActions, ",") {
+		trimmedStateAction := strings.TrimSpace(stateAction)
+		if len(trimmedStateAction) == 0 {
+			continue
+		}
+		parts := strings.SplitN(trimmedStateAction, "=", 2)
+		instanceState := strings.TrimSpace(parts[0])
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid instance state action, expected state=action: %s", trimmedStateAction)
+		}
+		if !validInstanceStates[instanceState] {
+			return fmt.Errorf("invalid instance state action state: %s", instanceState)
+		}
+		action := strings.TrimSpace(parts[1])
+		if action != actionDelete && action != actionSilence {
+			return fmt.Errorf("invalid instance state action for %s: %s", instanceState, action)
+		}
+		instanceStateActionsMap[instanceState] = action
+	}
+
+	// parse the state reason actions
+	stateReasonActionsMap = make(map[string]string)
+	for _, reasonAction := range strings.Split(stateReasonActions, ",") {
+		trimmedReasonAction := strings.TrimSpace(reasonAction)
+		if len(trimmedReasonAction) == 0 {
+			continue
+		}
+		parts := strings.SplitN(trimmedReasonAction, "=", 2)
+		category := strings.TrimSpace(parts[0])
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid state reason action, expected category=action: %s", trimmedReasonAction)
+		}
+		if !containsString(aws.StateReasonCategories, category) {
+			return fmt.Errorf("invalid state reason action category: %s", category)
+		}
+		action := strings.TrimSpace(parts[1])
+		if action != actionDelete && action != actionSilence {
+			return fmt.Errorf("invalid state reason action for %s: %s", category, action)
+		}
+		stateReasonActionsMap[category] = action
+	}
+	silenceExpireDuration = 0
+	if len(silenceExpire) > 0 {
+		duration, err := time.ParseDuration(silenceExpire)
+		if err != nil {
+			return fmt.Errorf("invalid silence-expire: %s", err)
+		}
+		if duration < time.Second {
+			return fmt.Errorf("silence-expire must be at least one second")
+		}
+		silenceExpireDuration = duration
+	}
+
+	// parse the accounts and the roles to assume in them
+	if len(awsConfig.AssumeRoleTemplate) > 0 {
+		if _, err := aws.ParseRoleTemplate(awsConfig.AssumeRoleTemplate); err != nil {
+			return err
+		}
+	}
+	awsConfig.AwsAccountsMap = make(map[string]string)
+	if len(awsAccountsFile) > 0 {
+		accountsJSON, err := ioutil.ReadFile(awsAccountsFile)
+		if err != nil {
+			return fmt.Errorf("unable to load aws-accounts-file: %s", err)
+		}
+		if err := json.Unmarshal(accountsJSON, &awsConfig.AwsAccountsMap); err != nil {
+			return fmt.Errorf("invalid aws-accounts-file: %s", err)
+		}
+		for accountID, roleArn := range awsConfig.AwsAccountsMap {
+			if !arn.IsARN(roleArn) {
+				return fmt.Errorf("aws-accounts-file role %s for account %s is not a valid ARN", roleArn, accountID)
+			}
+		}
+	}
+	awsConfig.AwsAccountsList = []string{}
+	for _, accountID := range strings.Split(awsConfig.AwsAccounts, ",") {
+		trimmedAccountID := strings.TrimSpace(accountID)
+		if len(trimmedAccountID) > 0 {
+			awsConfig.AwsAccountsList = append(awsConfig.AwsAccountsList, trimmedAccountID)
+		}
+	}
+	for accountID := range awsConfig.AwsAccountsMap {
+		if !containsString(awsConfig.AwsAccountsList, accountID) {
+			awsConfig.AwsAccountsList = append(awsConfig.AwsAccountsList, accountID)
+		}
+	}
+	sort.Strings(awsConfig.AwsAccountsList)
+
+	// parse the audit log destinations
+	auditLogDestinations = parseAuditLogDestinations(auditLog)
+	if auditLogMaxSize < 0 {
+		return fmt.Errorf("audit-log-max-size must not be negative")
+	}
+	if auditLogMaxBackups < 0 {
+		return fmt.Errorf("audit-log-max-backups must not be negative")
+	}
+
+	// parse the deregistration event configuration
+	if len(deregistrationEventEntity) > 0 {
+		if err := corev2.ValidateName(deregistrationEventEntity); err != nil {
+			return fmt.Errorf("invalid deregistration-event-entity: %s", err)
+		}
+	}
+	deregistrationEventHandlersList = []string{}
+	for _, handler := range strings.Split(deregistrationEventHandlers, ",") {
+		trimmedHandler := strings.TrimSpace(handler)
+		if len(trimmedHandler) > 0 {
+			deregistrationEventHandlersList = append(deregistrationEventHandlersList, trimmedHandler)
+		}
+	}
+	if deregistrationEventStatus < 0 || deregistrationEventStatus > 255 {
+		return fmt.Errorf("deregistration-event-status must be between 0 and 255")
+	}
+	deregistrationEventReasonsList = []string{}
+	for _, category := range strings.Split(deregistrationEventReasons, ",") {
+		trimmedCategory := strings.TrimSpace(category)
+		if len(trimmedCategory) == 0 {
+			continue
+		}
+		if !containsString(aws.StateReasonCategories, trimmedCategory) {
+			return fmt.Errorf("invalid deregistration-event-reasons category: %s", trimmedCategory)
+		}
+		deregistrationEventReasonsList = append(deregistrationEventReasonsList, trimmedCategory)
+	}
+	deregistrationEventReasonAnnotationsMap = make(map[string]map[string]string)
+	for _, reasonAnnotation := range strings.Split(deregistrationEventReasonAnnotations, ",") {
+		trimmedReasonAnnotation := strings.TrimSpace(reasonAnnotation)
+		if len(trimmedReasonAnnotation) == 0 {
+			continue
+		}
+		categoryParts := strings.SplitN(trimmedReasonAnnotation, ":", 2)
+		category := strings.TrimSpace(categoryParts[0])
+		if len(categoryParts) != 2 || !strings.Contains(categoryParts[1], "=") {
+			return fmt.Errorf("invalid deregistration event reason annotation, expected category:key=value: %s", trimmedReasonAnnotation)
+		}
+		if !containsString(aws.StateReasonCategories, category) {
+			return fmt.Errorf("invalid deregistration event reason annotation category: %s", category)
+		}
+		annotationParts := strings.SplitN(categoryParts[1], "=", 2)
+		key := strings.TrimSpace(annotationParts[0])
+		if len(key) == 0 {
+			return fmt.Errorf("invalid deregistration event reason annotation, empty key: %s", trimmedReasonAnnotation)
+		}
+		if deregistrationEventReasonAnnotationsMap[category] == nil {
+			deregistrationEventReasonAnnotationsMap[category] = make(map[string]string)
+		}
+		deregistrationEventReasonAnnotationsMap[category][key] = strings.TrimSpace(annotationParts[1])
+	}
+
+	// parse the deletions circuit breaker
+	if maxDeletions < 0 {
+		return fmt.Errorf("max-deletions must be 0 or greater")
+	}
+	if maxDeletions > 0 {
+		maxDeletionsWindowDuration, err = time.ParseDuration(maxDeletionsWindow)
+		if err != nil {
+			return fmt.Errorf("invalid max-deletions-window: %s", err)
+		}
+		if maxDeletionsWindowDuration <= 0 {
+			return fmt.Errorf("max-deletions-window must be greater than 0")
+		}
+		if len(maxDeletionsStateFile) == 0 {
+			return fmt.Errorf("max-deletions-state-file must contain a value")
+		}
+		if err := corev2.ValidateName(maxDeletionsEventEntity); err != nil {
+			return fmt.Errorf("invalid max-deletions-event-entity: %s", err)
+		}
+	}
+
+	// parse the retry policy
+	if retryMaxAttempts < 1 {
+		return fmt.Errorf("retry-max-attempts must be at least 1")
+	}
+	baseDelay, err := time.ParseDuration(retryBaseDelay)
+	if err != nil {
+		return fmt.Errorf("invalid retry-base-delay: %s", err)
+	}
+	maxDelay, err := time.ParseDuration(retryMaxDelay)
+	if err != nil {
+		return fmt.Errorf("invalid retry-max-delay: %s", err)
+	}
+	if baseDelay < 0 || maxDelay < baseDelay {
+		return fmt.Errorf("retry-max-delay must be greater than retry-base-delay")
+	}
+	awsConfig.RetryPolicy = retry.Policy{
+		MaxAttempts: retryMaxAttempts,
+		BaseDelay:   baseDelay,
+		MaxDelay:    maxDelay,
+	}
+
+	// parse the trigger checks
+	triggerChecksList = []string{}
+	for _, check := range strings.Split(triggerChecks, ",") {
+		trimmedCheck := strings.TrimSpace(check)
+		if len(trimmedCheck) > 0 {
+			triggerChecksList = append(triggerChecksList, trimmedCheck)
+		}
+	}
+	if len(triggerChecksList) == 0 {
+		return fmt.Errorf("trigger-checks must contain at least one check name")
+	}
+
+	// parse the event deletion patterns
+	deleteEventsIncludeList, err = parseCheckPatterns(deleteEventsInclude)
+	if err != nil {
+		return fmt.Errorf("invalid delete-events-include: %s", err)
+	}
+	deleteEventsExcludeList, err = parseCheckPatterns(deleteEventsExclude)
+	if err != nil {
+		return fmt.Errorf("invalid delete-events-exclude: %s", err)
+	}
+
+	// parse the archive destination
+	archiveTarget = nil
+	if len(archive) > 0 {
+		archiveTarget, err = parseArchiveDestination(archive)
+		if err != nil {
+			return fmt.Errorf("invalid archive: %s", err)
+		}
+	}
+	if archiveFormat != archiveFormatJSON && archiveFormat != archiveFormatYAML {
+		return fmt.Errorf("archive-format must be json or yaml")
+	}
+
+	// parse the search regions
+	awsConfig.AwsRegionsList = []string{}
+	for _, region := range strings.Split(awsConfig.AwsRegions, ",") {
+		trimmedRegion := strings.TrimSpace(region)
+		if len(trimmedRegion) > 0 {
+			awsConfig.AwsRegionsList = append(awsConfig.AwsRegionsList, trimmedRegion)
+		}
+	}
+
 	return nil
 }
 
@@ -210,80 +956,122 @@ func retrieveAwsInstanceID(event *corev2.Event) {
 		return
 	}
 
-	if len(awsInstanceIDLabel) > 0 {
-		if len(event.Entity.Labels[awsInstanceIDLabel]) > 0 {
-			log.Printf("Using %s entity label as the AWS instance ID\n", awsInstanceIDLabel)
-			awsConfig.AwsInstanceID = event.Entity.Labels[awsInstanceIDLabel]
+	awsConfig.AwsInstanceID = resolveAwsInstanceID(event.Entity)
+	if awsConfig.AwsInstanceID == event.Entity.Name {
+		log.Println("Using entity name as the AWS instance ID")
+	} else {
+		log.Printf("Using %s entity label as the AWS instance ID\n", awsInstanceIDLabel)
+	}
+}
+
+// resolveAwsInstanceID returns the AWS instance id of the entity, read from the
+// entity label if present, otherwise the entity name.
+func resolveAwsInstanceID(entity *corev2.Entity) string {
+	if len(awsInstanceIDLabel) > 0 && len(entity.Labels[awsInstanceIDLabel]) > 0 {
+		return entity.Labels[awsInstanceIDLabel]
+	}
+	return entity.Name
+}
+
+// resolveAwsAccountID returns the AWS account ID of the entity, read from the
+// account label. An empty account ID is returned if it is not set.
+func resolveAwsAccountID(entity *corev2.Entity) string {
+	if len(awsAccountIDLabel) > 0 {
+		return entity.Labels[awsAccountIDLabel]
+	}
+	return ""
+}
+
+// resolveAwsRegion returns the AWS region of the entity, read from the region
+// label, the availability zone label or the EC2 hostname of the entity. An
+// empty region is returned if it cannot be determined.
+func resolveAwsRegion(entity *corev2.Entity) string {
+	if len(awsRegionLabel) > 0 && len(entity.Labels[awsRegionLabel]) > 0 {
+		return entity.Labels[awsRegionLabel]
+	}
+	if len(awsAvailabilityZoneLabel) > 0 {
+		if region := awsRegionRegexp.FindString(entity.Labels[awsAvailabilityZoneLabel]); len(region) > 0 {
+			return region
 		}
 	}
-	if len(awsConfig.AwsInstanceID) == 0 {
-		log.Println("Using entity name as the AWS instance ID")
-		awsConfig.AwsInstanceID = event.Entity.Name
+	if strings.HasSuffix(entity.System.Hostname, ".ec2.internal") {
+		return "us-east-1"
 	}
+	if matches := ec2HostnameRegexp.FindStringSubmatch(entity.System.Hostname); matches != nil {
+		return matches[1]
+	}
+	return ""
 }
 
 // executeHandler is executed by the go handler and executes the handler business logic.
 func executeHandler(event *corev2.Event) error {
-	if event.Check.Name != keepAliveEventName {
-		return fmt.Errorf("received non-keepalive event, not checking ec2 instance state")
+	ctx, cancel := runContext()
+	defer cancel()
+	ctx, retries := retry.WithCounter(ctx)
+
+	report, err := handleEvent(ctx, event)
+	return auditDecision(auditCommandHandler, retries, event.Entity, awsConfig.AwsInstanceID, report, err)
+}
+
+// handleEvent deregisters the entity of the event if its instance does not have
+// an allowed state. The report is nil if no decision could be taken.
+func handleEvent(ctx context.Context, event *corev2.Event) (*deregistrationReport, error) {
+	if !containsString(triggerChecksList, event.Check.Name) {
+		return nil, fmt.Errorf("received event of check %s, not a trigger check, not checking ec2 instance state", event.Check.Name)
 	}
 
-	awsHandler, err := aws.NewHandler(&awsConfig)
+	// Protected entities are kept even if their instance cannot be looked up
+	if protection := entityProtection(event.Entity); len(protection) > 0 {
+		report := newProtectedReport(event.Entity, awsConfig.AwsInstanceID, protection)
+		if dryRun {
+			return report, report.print(os.Stdout)
+		}
+		return report, nil
+	}
+
+	awsHandler, err := aws.NewHandler(&awsConfig, awsClientFactories)
 	if err != nil {
-		return fmt.Errorf("could not initialize handler: %s", err)
+		return nil, fmt.Errorf("could not initialize handler: %s", err)
 	}
 
 	log.Println("Getting AWS instance state")
-	instanceState, getErr := awsHandler.GetInstanceState()
+	instanceStatus, getErr := awsHandler.GetInstanceStatusWithContext(ctx, awsConfig.AwsInstanceID, resolveAwsAccountID(event.Entity), resolveAwsRegion(event.Entity))
 	if getErr != nil {
-		return fmt.Errorf("could not get instance state: %s", getErr)
+		return nil, phaseError(ctx, "getting the instance state", fmt.Errorf("could not get instance state: %s", getErr))
 	}
-
-	log.Printf("Instance state: %s", instanceState)
+	log.Printf("Instance state: %s (%s)", instanceStatus.State, instanceStatus.Region)
 
 	// Validate instance state
-	if _, ok := awsConfig.AllowedInstanceStatesMap[instanceState]; ok {
-		log.Printf("'%s' is a valid instance state, not deregistering '%s' entity from Sensu for '%s' AWS instance", instanceState,
-			event.Entity.Name, awsConfig.AwsInstanceID)
-		return nil
+	report, err := evaluateDeregistration(ctx, awsHandler, event, event.Entity, instanceStatus)
+	if err != nil {
+		return nil, err
 	}
-	log.Printf("'%s' is not a valid instance state, deregistering '%s' entity from Sensu for '%s' AWS instance", instanceState,
-		event.Entity.Name, awsConfig.AwsInstanceID)
 
-	// First authenticate against the Sensu API
-	config := httpclient.CoreClientConfig{
-		URL:    sensuAPIURL,
-		APIKey: sensuAPIKey,
+	if dryRun {
+		log.Printf("Dry-run mode enabled, not deleting entity (%s/%s)", event.Entity.Namespace, event.Entity.Name)
+		return report, report.print(os.Stdout)
 	}
-	if sensuCACert != "" {
-		asn1Data, err := ioutil.ReadFile(sensuCACert)
-		if err != nil {
-			return fmt.Errorf("unable to load sensu-ca-cert: %s", err)
-		}
-		cert, err := x509.ParseCertificate(asn1Data)
-		if err != nil {
-			return fmt.Errorf("invalid sensu-ca-cert: %s", err)
-		}
-		config.CACert = cert
-
+	if !report.Deregister {
+		return report, nil
 	}
-	client := httpclient.NewCoreClient(config)
-	request, err := httpclient.NewResourceRequest("core/v2", "Entity", event.Entity.Namespace, event.Entity.Name)
+
+	client, err := newSensuClient()
 	if err != nil {
-		return err
+		return report, err
 	}
 
-	// Delete the Sensu entity
-	log.Printf("Deleting entity (%s/%s)", event.Entity.Namespace, event.Entity.Name)
-	if _, err := client.DeleteResource(context.Background(), request); err != nil {
-		if httperr, ok := err.(httpclient.HTTPError); ok {
-			if httperr.StatusCode < 500 {
-				log.Printf("entity already deleted (%s/%s)", event.Entity.Namespace, event.Entity.Name)
-				return nil
-			}
-		}
-		return err
+	staleSince := event.Timestamp
+	if staleSince == 0 {
+		staleSince = event.Entity.LastSeen
 	}
+	return report, executeAction(ctx, client, event.Entity, report, []string{event.Check.Name}, staleSince)
+}
 
-	return nil
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
 }
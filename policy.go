@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/robertkrimen/otto"
+	"github.com/sensu/sensu-ec2-handler/aws"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+var (
+	errPolicyInterrupted = errors.New("policy evaluation interrupted")
+)
+
+// decisionPolicy is a compiled JavaScript policy expression deciding the
+// action taken on an entity. The expression is evaluated with the event, entity
+// and instance variables, and returns "delete", "silence" or "keep", or a
+// boolean to deregister the entity with the action of its instance state.
+type decisionPolicy struct {
+	script *otto.Script
+}
+
+// policyInstance is the instance variable of the policy expression.
+type policyInstance struct {
+	ID                    string            `json:"id"`
+	AccountID             string            `json:"account_id"`
+	Region                string            `json:"region"`
+	State                 string            `json:"state"`
+	InstanceType          string            `json:"instance_type"`
+	LaunchTime            *time.Time        `json:"launch_time"`
+	VpcID                 string            `json:"vpc_id"`
+	InstanceLifecycle     string            `json:"instance_lifecycle"`
+	StateReasonCode       string            `json:"state_reason_code"`
+	StateReasonCategory   string            `json:"state_reason_category"`
+	StateTransitionReason string            `json:"state_transition_reason"`
+	Tags                  map[string]string `json:"tags"`
+	StateTransitionTime   *time.Time        `json:"state_transition_time"`
+	// StateAge is the number of seconds since the state transition time, or
+	// -1 when it is unknown
+	StateAge    int64         `json:"state_age"`
+	Description *ec2.Instance `json:"description"`
+}
+
+// parsePolicy compiles the policy expression.
+func parsePolicy(source string) (*decisionPolicy, error) {
+	script, err := otto.New().Compile("policy", source)
+	if err != nil {
+		return nil, err
+	}
+	return &decisionPolicy{script: script}, nil
+}
+
+// newPolicyInstance creates the instance variable of the policy expression. The
+// description is nil when the instance could not be found.
+func newPolicyInstance(instanceStatus *aws.InstanceStatus, description *aws.Instance) *policyInstance {
+	instance := &policyInstance{
+		ID:        instanceStatus.InstanceID,
+		AccountID: instanceStatus.AccountID,
+		Region:    instanceStatus.Region,
+		State:     instanceStatus.State,
+		Tags:      make(map[string]string),
+		StateAge:  -1,
+	}
+	if description == nil {
+		return instance
+	}
+	instance.InstanceType = description.InstanceType
+	instance.LaunchTime = description.LaunchTime
+	instance.VpcID = description.VpcID
+	instance.InstanceLifecycle = description.InstanceLifecycle
+	instance.StateReasonCode = description.StateReasonCode
+	instance.StateReasonCategory = description.StateReasonCategory
+	instance.StateTransitionReason = description.StateTransitionReason
+	instance.Description = description.Description
+	for key, value := range description.Tags {
+		instance.Tags[key] = value
+	}
+	if transitionTime := description.StateTransitionTime(); !transitionTime.IsZero() {
+		instance.StateTransitionTime = &transitionTime
+		instance.StateAge = int64(time.Since(transitionTime).Seconds())
+	}
+	return instance
+}
+
+// evaluate evaluates the policy expression against the event, which is nil
+// outside of the handler, the entity and the instance. The evaluation is
+// interrupted when the context is done.
+func (policy *decisionPolicy) evaluate(ctx context.Context, event *corev2.Event, entity *corev2.Entity, instance *policyInstance) (result string, err error) {
+	vm := otto.New()
+	variables := map[string]interface{}{
+		"event":    event,
+		"entity":   entity,
+		"instance": instance,
+	}
+	for name, variable := range variables {
+		if err := setJSONVariable(vm, name, variable); err != nil {
+			return "", fmt.Errorf("error setting policy variable %s: %s", name, err)
+		}
+	}
+
+	vm.Interrupt = make(chan func(), 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			vm.Interrupt <- func() {
+				panic(errPolicyInterrupted)
+			}
+		case <-done:
+		}
+	}()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if recovered != errPolicyInterrupted {
+				panic(recovered)
+			}
+			err = errPolicyInterrupted
+		}
+	}()
+
+	value, err := vm.Run(policy.script)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case value.IsBoolean():
+		deregister, _ := value.ToBoolean()
+		if !deregister {
+			return actionKeep, nil
+		}
+		return "", nil
+	case value.IsString():
+		result = value.String()
+		if result == actionDelete || result == actionSilence || result == actionKeep {
+			return result, nil
+		}
+	}
+	return "", fmt.Errorf("policy returned %s, expected delete, silence, keep or a boolean", value)
+}
+
+// setJSONVariable sets the variable to the JavaScript object of the JSON
+// encoding of the value, so that the policy can use the usual object and array
+// methods on it.
+func setJSONVariable(vm *otto.Otto, name string, value interface{}) error {
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	object, err := vm.Run("(" + string(valueBytes) + ")")
+	if err != nil {
+		return err
+	}
+	return vm.Set(name, object)
+}
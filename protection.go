@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/sensu/sensu-ec2-handler/aws"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// entityProtection returns why the entity is protected from deregistration by
+// the protection label or annotation, or an empty string if it is not.
+func entityProtection(entity *corev2.Entity) string {
+	if len(protectionLabel) == 0 {
+		return ""
+	}
+	if isProtectionValue(entity.Labels[protectionLabel]) {
+		return fmt.Sprintf("entity label %s", protectionLabel)
+	}
+	if isProtectionValue(entity.Annotations[protectionLabel]) {
+		return fmt.Sprintf("entity annotation %s", protectionLabel)
+	}
+	return ""
+}
+
+// instanceProtection returns why the instance is protected from deregistration
+// by the protection tag, or an empty string if it is not. The instance is
+// described if the report does not have its description yet.
+func instanceProtection(ctx context.Context, awsHandler *aws.Handler, instanceStatus *aws.InstanceStatus, report *deregistrationReport) (string, error) {
+	if len(awsProtectionTag) == 0 || instanceStatus.State == aws.InstanceStateNotFound {
+		return "", nil
+	}
+	instance, err := describeInstance(ctx, awsHandler, instanceStatus, report)
+	if err != nil {
+		return "", err
+	}
+	if isProtectionValue(instance.Tags[awsProtectionTag]) {
+		return fmt.Sprintf("EC2 tag %s", awsProtectionTag), nil
+	}
+	return "", nil
+}
+
+// isProtectionValue returns true if the label, annotation or tag value enables
+// the protection.
+func isProtectionValue(value string) bool {
+	protected, err := strconv.ParseBool(strings.TrimSpace(value))
+	return err == nil && protected
+}
+
+// newProtectedReport creates the report of a protected entity, which is kept
+// without looking its instance up.
+func newProtectedReport(entity *corev2.Entity, instanceID string, protection string) *deregistrationReport {
+	log.Printf("Protected by the %s, not deregistering '%s' entity from Sensu for '%s' AWS instance", protection, entity.Name, instanceID)
+	report := newDeregistrationReport(entity, &aws.InstanceStatus{InstanceID: instanceID})
+	report.Deregister = false
+	report.Protected = protection
+	return report
+}
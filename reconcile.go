@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"text/tabwriter"
+
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-ec2-handler/aws"
+	"github.com/sensu/sensu-ec2-handler/retry"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+const (
+	reconcileCommand = "reconcile"
+)
+
+var (
+	reconcileConfig = sensu.PluginConfig{
+		Name:    "sensu-ec2-handler reconcile",
+		Short:   "removes all the sensu entities of a namespace that do not have an allowed ec2 instance state",
+		Timeout: 10,
+	}
+
+	reconcileNamespace string
+
+	// awsInstanceIDRegexp matches the short and long EC2 instance ID formats
+	awsInstanceIDRegexp = regexp.MustCompile(`^i-([0-9a-f]{8}|[0-9a-f]{17})$`)
+)
+
+// instanceLocation is the account and region an instance is looked up in
+type instanceLocation struct {
+	accountID string
+	region    string
+}
+
+// reconcileResult is the outcome of the reconciliation of a single entity
+type reconcileResult struct {
+	*deregistrationReport
+	Action string
+}
+
+// reconcileOptions returns the handler options along with the options specific
+// to the reconcile command.
+func reconcileOptions() []*sensu.PluginConfigOption {
+	return append([]*sensu.PluginConfigOption{
+		{
+			Env:       "SENSU_NAMESPACE",
+			Argument:  "namespace",
+			Shorthand: "n",
+			Default:   "default",
+			Usage:     "The Sensu namespace to reconcile",
+			Value:     &reconcileNamespace,
+		},
+	}, options...)
+}
+
+// checkReconcileArgs is invoked by the go check to perform validation of the values.
+func checkReconcileArgs(_ *corev2.Event) (int, error) {
+	if len(reconcileNamespace) == 0 {
+		return sensu.CheckStateUnknown, fmt.Errorf("namespace must contain a value")
+	}
+	if err := validateConfig(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	return sensu.CheckStateOK, nil
+}
+
+// executeReconcile deregisters all the EC2 entities of the namespace that do
+// not have an allowed instance state, and prints a summary of the actions taken.
+func executeReconcile(_ *corev2.Event) (int, error) {
+	ctx, cancel := runContext()
+	defer cancel()
+	client, err := newSensuClient()
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+
+	entities, err := listEntities(ctx, client, reconcileNamespace)
+	if err != nil {
+		return sensu.CheckStateUnknown, phaseError(ctx, "listing the entities", err)
+	}
+
+	// Only keep the entities backed by an EC2 instance, grouping their
+	// instances by account and region
+	ec2Entities := []*corev2.Entity{}
+	instanceIDs := []string{}
+	locationInstanceIDs := make(map[instanceLocation][]string)
+	for _, entity := range entities {
+		instanceID := resolveAwsInstanceID(entity)
+		if !awsInstanceIDRegexp.MatchString(instanceID) {
+			continue
+		}
+		ec2Entities = append(ec2Entities, entity)
+		instanceIDs = append(instanceIDs, instanceID)
+		// Protected entities are kept without looking their instance up
+		if len(entityProtection(entity)) > 0 {
+			continue
+		}
+		location := instanceLocation{accountID: resolveAwsAccountID(entity), region: resolveAwsRegion(entity)}
+		locationInstanceIDs[location] = append(locationInstanceIDs[location], instanceID)
+	}
+	log.Printf("Found %d EC2 entities out of %d entities in namespace %s", len(ec2Entities), len(entities), reconcileNamespace)
+	if len(ec2Entities) == 0 {
+		return sensu.CheckStateOK, nil
+	}
+
+	awsHandler, err := aws.NewHandler(&awsConfig, awsClientFactories)
+	if err != nil {
+		return sensu.CheckStateUnknown, fmt.Errorf("could not initialize handler: %s", err)
+	}
+	instanceStatuses := make(map[string]*aws.InstanceStatus, len(instanceIDs))
+	for location, locationIDs := range locationInstanceIDs {
+		locationStatuses, err := awsHandler.GetInstanceStatusesWithContext(ctx, locationIDs, location.accountID, location.region)
+		if err != nil {
+			err = phaseError(ctx, "getting the instance states", fmt.Errorf("could not get instance states: %s", err))
+			for i, entity := range ec2Entities {
+				_ = auditDecision(reconcileCommand, nil, entity, instanceIDs[i], nil, err)
+			}
+			return sensu.CheckStateUnknown, err
+		}
+		for instanceID, instanceStatus := range locationStatuses {
+			instanceStatuses[instanceID] = instanceStatus
+		}
+	}
+
+	results := make([]*reconcileResult, 0, len(ec2Entities))
+	failures := 0
+	for i, entity := range ec2Entities {
+		entityCtx, retries := retry.WithCounter(ctx)
+		var report *deregistrationReport
+		var err error
+		if protection := entityProtection(entity); len(protection) > 0 {
+			report = newProtectedReport(entity, instanceIDs[i], protection)
+		} else {
+			report, err = evaluateDeregistration(entityCtx, awsHandler, nil, entity, instanceStatuses[instanceIDs[i]])
+		}
+		if err != nil {
+			report = newDeregistrationReport(entity, instanceStatuses[instanceIDs[i]])
+			report.Deregister = false
+		}
+		result := &reconcileResult{deregistrationReport: report}
+		switch {
+		case err != nil:
+		case len(result.Protected) > 0:
+			result.Action = fmt.Sprintf("%s (protected)", actionKeep)
+		case !result.Deregister:
+			result.Action = actionKeep
+		case dryRun:
+			result.Action = fmt.Sprintf("%s (dry-run)", report.Action)
+		default:
+			// The entity is not stale if any of the trigger checks recovered,
+			// since reconcile does not know which one it was handled for
+			err = executeAction(entityCtx, client, entity, report, triggerChecksList, entity.LastSeen)
+			result.Action = report.Action
+			if len(report.Aborted) > 0 {
+				result.Action = fmt.Sprintf("%s (aborted)", actionKeep)
+			}
+			if len(report.Unchanged) > 0 {
+				result.Action = fmt.Sprintf("%s (%s)", report.Action, report.Unchanged)
+			}
+		}
+		if err != nil {
+			result.Action = fmt.Sprintf("error: %s", err)
+			failures++
+		}
+		if auditErr := auditDecision(reconcileCommand, retries, entity, instanceIDs[i], report, err); auditErr != nil && err == nil {
+			result.Action = fmt.Sprintf("error: %s", auditErr)
+			failures++
+		}
+		results = append(results, result)
+	}
+
+	if err := printReconcileSummary(os.Stdout, results); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if failures > 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("%d entities could not be reconciled", failures)
+	}
+
+	return sensu.CheckStateOK, nil
+}
+
+// printReconcileSummary writes the reconcile results as a table to the writer.
+func printReconcileSummary(writer io.Writer, results []*reconcileResult) error {
+	tabWriter := tabwriter.NewWriter(writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tabWriter, "ENTITY\tINSTANCE ID\tREGION\tSTATE\tACTION")
+	for _, result := range results {
+		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\t%s\n", result.Entity, result.InstanceID, result.Region, result.InstanceState, result.Action)
+	}
+	return tabWriter.Flush()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/sensu/sensu-ec2-handler/aws"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+// deregistrationReport describes the deregistration decision taken for an
+// entity. It is printed instead of deleting the entity when running in dry-run
+// mode.
+type deregistrationReport struct {
+	Namespace     string   `json:"namespace"`
+	Entity        string   `json:"entity"`
+	InstanceID    string   `json:"instance_id"`
+	AccountID     string   `json:"account_id,omitempty"`
+	Region        string   `json:"region"`
+	InstanceState string   `json:"instance_state"`
+	AllowedStates []string `json:"allowed_states"`
+	// Instance is the description of the instance, only set when the
+	// instance was described
+	Instance *aws.Instance `json:"instance,omitempty"`
+	// LifecycleState is only set when the Auto Scaling lifecycle state was
+	// looked up
+	LifecycleState string `json:"lifecycle_state,omitempty"`
+	// TagRule is the tag rule that matched the instance tags, if any
+	TagRule string `json:"tag_rule,omitempty"`
+	// Protected is why the entity is protected from deregistration, if it is
+	Protected string `json:"protected,omitempty"`
+	// Aborted is why the deletion was aborted when the entity turned out to
+	// no longer be stale
+	Aborted string `json:"aborted,omitempty"`
+	// Unchanged is why the action left the entity as it was, for example
+	// when it was already silenced
+	Unchanged string `json:"unchanged,omitempty"`
+	// Policy is true when the decision was taken by the policy expression
+	Policy bool `json:"policy,omitempty"`
+	// StateTransitionTime and MinStateAge are only set when a minimum age
+	// is configured for the instance state, or the transition time for the
+	// policy expression
+	StateTransitionTime *time.Time `json:"state_transition_time,omitempty"`
+	MinStateAge         string     `json:"min_state_age,omitempty"`
+	Deregister          bool       `json:"deregister"`
+	Action              string     `json:"action,omitempty"`
+	DryRun              bool       `json:"dry_run"`
+	// Archive is the location of the definition of the entity archived
+	// before deleting it
+	Archive string `json:"archive,omitempty"`
+	// Events are the outcomes of the deletions of the events of the entity
+	Events []*eventDeletion `json:"events,omitempty"`
+}
+
+// newDeregistrationReport creates a report for the given entity and observed
+// instance status using the current handler configuration.
+func newDeregistrationReport(entity *corev2.Entity, instanceStatus *aws.InstanceStatus) *deregistrationReport {
+	return &deregistrationReport{
+		Namespace:     entity.Namespace,
+		Entity:        entity.Name,
+		InstanceID:    instanceStatus.InstanceID,
+		AccountID:     instanceStatus.AccountID,
+		Region:        instanceStatus.Region,
+		InstanceState: instanceStatus.State,
+		AllowedStates: allowedInstanceStates(),
+		Deregister:    !awsConfig.AllowedInstanceStatesMap[instanceStatus.State],
+		DryRun:        dryRun,
+	}
+}
+
+// stateReasonCategory returns the state reason category of the instance, none
+// when it was not described.
+func (report *deregistrationReport) stateReasonCategory() string {
+	if report.Instance == nil {
+		return aws.StateReasonNone
+	}
+	return report.Instance.StateReasonCategory
+}
+
+// allowedInstanceStates returns the sorted allowed instance states.
+func allowedInstanceStates() []string {
+	allowedStates := make([]string, 0, len(awsConfig.AllowedInstanceStatesMap))
+	for state := range awsConfig.AllowedInstanceStatesMap {
+		allowedStates = append(allowedStates, state)
+	}
+	sort.Strings(allowedStates)
+	return allowedStates
+}
+
+// print writes the report as an indented JSON document to the writer.
+func (report *deregistrationReport) print(writer io.Writer) error {
+	reportBytes, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling report to json: %s", err)
+	}
+	_, err = fmt.Fprintln(writer, string(reportBytes))
+	return err
+}
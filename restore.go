@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/httpclient"
+	"github.com/sensu-community/sensu-plugin-sdk/sensu"
+	"github.com/sensu/sensu-ec2-handler/aws"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+	"github.com/sensu/sensu-go/types"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	restoreCommand = "restore"
+)
+
+var (
+	restoreConfig = sensu.PluginConfig{
+		Name:    "sensu-ec2-handler restore",
+		Short:   "re-creates the sensu entities archived before being deleted",
+		Timeout: 10,
+	}
+
+	restoreSelector     string
+	restoreSelectorList []string
+	restoreSince        string
+	restoreSinceTime    time.Time
+	restoreUntil        string
+	restoreUntilTime    time.Time
+	restoreForce        bool
+)
+
+// entityArchive is an archived entity definition, named
+// namespace/entity/timestamp.format in the archive destination.
+type entityArchive struct {
+	Namespace string
+	Name      string
+	Time      time.Time
+	Format    string
+	location  string
+}
+
+// restoreResult is the outcome of the restoration of a single entity
+type restoreResult struct {
+	*entityArchive
+	Action string
+}
+
+// restoreOptions returns the handler options along with the options specific
+// to the restore command.
+func restoreOptions() []*sensu.PluginConfigOption {
+	return append([]*sensu.PluginConfigOption{
+		{
+			Env:      "RESTORE_SELECTOR",
+			Argument: "selector",
+			Default:  "*/*",
+			Usage:    "The namespace/name patterns of the entities to restore, comma separated, where * matches any characters",
+			Value:    &restoreSelector,
+		},
+		{
+			Env:      "RESTORE_SINCE",
+			Argument: "since",
+			Default:  "",
+			Usage:    "The start of the time range of the archives to restore, an RFC 3339 time or a duration before now, for example 24h (defaults to all the archives)",
+			Value:    &restoreSince,
+		},
+		{
+			Env:      "RESTORE_UNTIL",
+			Argument: "until",
+			Default:  "",
+			Usage:    "The end of the time range of the archives to restore, an RFC 3339 time or a duration before now (defaults to now)",
+			Value:    &restoreUntil,
+		},
+		{
+			Env:      "RESTORE_FORCE",
+			Argument: "force",
+			Default:  false,
+			Usage:    "Overwrite the entities that already exist instead of skipping them",
+			Value:    &restoreForce,
+		},
+	}, options...)
+}
+
+// checkRestoreArgs is invoked by the go check to perform validation of the values.
+func checkRestoreArgs(_ *corev2.Event) (int, error) {
+	if err := validateConfig(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if err := validateRestoreConfig(); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	return sensu.CheckStateOK, nil
+}
+
+// validateRestoreConfig validates the configuration specific to the restore
+// command.
+func validateRestoreConfig() error {
+	if archiveTarget == nil {
+		return fmt.Errorf("archive must contain a value")
+	}
+	if len(archiveTarget.url) > 0 {
+		return fmt.Errorf("http(s) archives can not be listed, copy the archives to a directory to restore them")
+	}
+
+	restoreSelectorList = []string{}
+	for _, selector := range strings.Split(restoreSelector, ",") {
+		trimmedSelector := strings.TrimSpace(selector)
+		if len(trimmedSelector) == 0 {
+			continue
+		}
+		if strings.Count(trimmedSelector, "/") != 1 {
+			return fmt.Errorf("invalid selector %s, expected namespace/name", trimmedSelector)
+		}
+		if _, err := path.Match(trimmedSelector, ""); err != nil {
+			return fmt.Errorf("invalid selector %s: %s", trimmedSelector, err)
+		}
+		restoreSelectorList = append(restoreSelectorList, trimmedSelector)
+	}
+	if len(restoreSelectorList) == 0 {
+		return fmt.Errorf("selector must contain at least one value")
+	}
+
+	var err error
+	now := time.Now()
+	if restoreSinceTime, err = parseRestoreTime(restoreSince, now); err != nil {
+		return fmt.Errorf("invalid since: %s", err)
+	}
+	if restoreUntilTime, err = parseRestoreTime(restoreUntil, now); err != nil {
+		return fmt.Errorf("invalid until: %s", err)
+	}
+	if !restoreUntilTime.IsZero() && restoreSinceTime.After(restoreUntilTime) {
+		return fmt.Errorf("since must be before until")
+	}
+	return nil
+}
+
+// parseRestoreTime parses an RFC 3339 time, or a duration before now. An empty
+// value is the zero time.
+func parseRestoreTime(value string, now time.Time) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is neither an RFC 3339 time nor a duration", value)
+	}
+	return now.Add(-duration), nil
+}
+
+// executeRestore re-creates the selected entities from their latest archive in
+// the time range, and prints a summary of the actions taken.
+func executeRestore(_ *corev2.Event) (int, error) {
+	ctx, cancel := runContext()
+	defer cancel()
+	client, err := newSensuClient()
+	if err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	var awsHandler *aws.Handler
+	if len(archiveTarget.bucket) > 0 {
+		awsHandler, err = aws.NewHandler(&awsConfig, awsClientFactories)
+		if err != nil {
+			return sensu.CheckStateUnknown, fmt.Errorf("could not initialize handler: %s", err)
+		}
+	}
+
+	archives, err := listArchives(ctx, awsHandler)
+	if err != nil {
+		return sensu.CheckStateUnknown, phaseError(ctx, "listing the archives", err)
+	}
+	archives = selectArchives(archives)
+	log.Printf("Found %d archived entities to restore", len(archives))
+
+	results := make([]*restoreResult, 0, len(archives))
+	failures := 0
+	for _, archive := range archives {
+		result := &restoreResult{entityArchive: archive}
+		result.Action, err = restoreEntity(ctx, client, awsHandler, archive)
+		if err != nil {
+			result.Action = fmt.Sprintf("error: %s", err)
+			failures++
+		}
+		results = append(results, result)
+	}
+
+	if err := printRestoreSummary(os.Stdout, results); err != nil {
+		return sensu.CheckStateUnknown, err
+	}
+	if failures > 0 {
+		return sensu.CheckStateWarning, fmt.Errorf("%d entities could not be restored", failures)
+	}
+	return sensu.CheckStateOK, nil
+}
+
+// restoreEntity re-creates the entity of the archive, unless it already exists
+// and the restoration is not forced. The action taken is returned.
+func restoreEntity(ctx context.Context, client *httpclient.CoreClient, awsHandler *aws.Handler, archive *entityArchive) (string, error) {
+	content, err := readArchive(ctx, awsHandler, archive)
+	if err != nil {
+		return "", phaseError(ctx, "reading the archive", err)
+	}
+	entity, err := decodeArchive(content, archive.Format)
+	if err != nil {
+		return "", fmt.Errorf("could not decode %s: %s", archive.location, err)
+	}
+	if entity.Namespace != archive.Namespace || entity.Name != archive.Name {
+		return "", fmt.Errorf("%s contains entity %s/%s", archive.location, entity.Namespace, entity.Name)
+	}
+
+	if !restoreForce {
+		existing, err := getEntity(ctx, client, entity.Namespace, entity.Name)
+		if err != nil {
+			return "", phaseError(ctx, "getting the entity", fmt.Errorf("could not get entity: %s", err))
+		}
+		if existing != nil {
+			log.Printf("Entity already exists, not restoring (%s/%s)", entity.Namespace, entity.Name)
+			return "skip (exists)", nil
+		}
+	}
+	if dryRun {
+		return "restore (dry-run)", nil
+	}
+	if err := putEntity(ctx, client, entity); err != nil {
+		return "", phaseError(ctx, "restoring the entity", fmt.Errorf("could not restore entity: %s", err))
+	}
+	return "restored", nil
+}
+
+// listArchives lists the entity archives of the archive destination, the files
+// that are not named like archives are ignored.
+func listArchives(ctx context.Context, awsHandler *aws.Handler) ([]*entityArchive, error) {
+	archives := []*entityArchive{}
+	if len(archiveTarget.bucket) > 0 {
+		prefix := ""
+		if len(archiveTarget.prefix) > 0 {
+			prefix = archiveTarget.prefix + "/"
+		}
+		keys, err := awsHandler.ListObjectsWithContext(ctx, archiveTarget.bucket, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if archive := parseArchiveName(strings.TrimPrefix(key, prefix)); archive != nil {
+				archive.location = key
+				archives = append(archives, archive)
+			}
+		}
+		return archives, nil
+	}
+
+	err := filepath.Walk(archiveTarget.directory, func(location string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, err := filepath.Rel(archiveTarget.directory, location)
+		if err != nil {
+			return err
+		}
+		if archive := parseArchiveName(filepath.ToSlash(name)); archive != nil {
+			archive.location = location
+			archives = append(archives, archive)
+		}
+		return nil
+	})
+	return archives, err
+}
+
+// parseArchiveName parses the namespace/entity/timestamp.format name of an
+// archive, nil is returned if it is not an archive name.
+func parseArchiveName(name string) *entityArchive {
+	parts := strings.Split(name, "/")
+	if len(parts) != 3 {
+		return nil
+	}
+	extension := path.Ext(parts[2])
+	format := strings.TrimPrefix(extension, ".")
+	if format != archiveFormatJSON && format != archiveFormatYAML {
+		return nil
+	}
+	archiveTime, err := time.Parse(archiveTimeFormat, strings.TrimSuffix(parts[2], extension))
+	if err != nil {
+		return nil
+	}
+	return &entityArchive{Namespace: parts[0], Name: parts[1], Time: archiveTime, Format: format}
+}
+
+// selectArchives returns the latest archive of each entity matching the
+// selector within the time range, sorted by namespace and name.
+func selectArchives(archives []*entityArchive) []*entityArchive {
+	latest := make(map[string]*entityArchive)
+	for _, archive := range archives {
+		if !matchCheckPatterns(restoreSelectorList, archive.Namespace+"/"+archive.Name) {
+			continue
+		}
+		if archive.Time.Before(restoreSinceTime) || (!restoreUntilTime.IsZero() && archive.Time.After(restoreUntilTime)) {
+			continue
+		}
+		key := archive.Namespace + "/" + archive.Name
+		if previous, ok := latest[key]; !ok || archive.Time.After(previous.Time) {
+			latest[key] = archive
+		}
+	}
+
+	selected := make([]*entityArchive, 0, len(latest))
+	for _, archive := range latest {
+		selected = append(selected, archive)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		if selected[i].Namespace != selected[j].Namespace {
+			return selected[i].Namespace < selected[j].Namespace
+		}
+		return selected[i].Name < selected[j].Name
+	})
+	return selected
+}
+
+// readArchive reads the content of the archive.
+func readArchive(ctx context.Context, awsHandler *aws.Handler, archive *entityArchive) ([]byte, error) {
+	if len(archiveTarget.bucket) > 0 {
+		return awsHandler.GetObjectWithContext(ctx, archiveTarget.bucket, archive.location)
+	}
+	return ioutil.ReadFile(archive.location)
+}
+
+// decodeArchive decodes the entity of the archive content, wrapped with its
+// type and API version.
+func decodeArchive(content []byte, format string) (*corev2.Entity, error) {
+	if format == archiveFormatYAML {
+		var value interface{}
+		if err := yaml.Unmarshal(content, &value); err != nil {
+			return nil, err
+		}
+		var err error
+		if content, err = json.Marshal(jsonValue(value)); err != nil {
+			return nil, err
+		}
+	}
+
+	wrapper := types.Wrapper{}
+	if err := json.Unmarshal(content, &wrapper); err != nil {
+		return nil, err
+	}
+	entity, ok := wrapper.Value.(*corev2.Entity)
+	if !ok {
+		return nil, fmt.Errorf("found %s resource, expected Entity", wrapper.Type)
+	}
+	return entity, nil
+}
+
+// jsonValue converts the maps decoded from YAML, whose keys can be of any
+// type, to maps that can be encoded to JSON.
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range value {
+			value[i] = jsonValue(item)
+		}
+	}
+	return value
+}
+
+// printRestoreSummary writes the restore results as a table to the writer.
+func printRestoreSummary(writer io.Writer, results []*restoreResult) error {
+	tabWriter := tabwriter.NewWriter(writer, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tabWriter, "NAMESPACE\tENTITY\tARCHIVED\tACTION")
+	for _, result := range results {
+		fmt.Fprintf(tabWriter, "%s\t%s\t%s\t%s\n", result.Namespace, result.Name, result.Time.Format(time.RFC3339), result.Action)
+	}
+	return tabWriter.Flush()
+}
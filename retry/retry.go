@@ -0,0 +1,98 @@
+package retry
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	jitterRand      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterRandMutex sync.Mutex
+)
+
+// Policy is a retry policy using a capped exponential backoff with full
+// jitter. The zero value makes a single attempt.
+type Policy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled for each retry
+	BaseDelay time.Duration
+	// MaxDelay caps the delay before a retry, the delay does not grow when
+	// it is zero
+	MaxDelay time.Duration
+}
+
+// Retryable classifies the errors of an operation, it returns true if the
+// operation may succeed when retried.
+type Retryable func(err error) bool
+
+// Counter counts the retries made within a context.
+type Counter struct {
+	retries int64
+}
+
+type counterKey struct{}
+
+// WithCounter returns a context counting the retries made by the policies it
+// is passed to.
+func WithCounter(ctx context.Context) (context.Context, *Counter) {
+	counter := &Counter{}
+	return context.WithValue(ctx, counterKey{}, counter), counter
+}
+
+// Retries returns the number of retries counted.
+func (counter *Counter) Retries() int {
+	if counter == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&counter.retries))
+}
+
+// Do calls the operation until it succeeds, fails with an error that is not
+// retryable, the attempts are exhausted or the context is done. The error of
+// the last attempt is returned.
+func (policy Policy) Do(ctx context.Context, operation string, retryable Retryable, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= policy.MaxAttempts || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+
+		delay := policy.Delay(attempt)
+		log.Printf("%s failed (attempt %d/%d), retrying in %s: %s\n", operation, attempt, policy.MaxAttempts, delay.Round(time.Millisecond), err)
+		if counter, ok := ctx.Value(counterKey{}).(*Counter); ok {
+			atomic.AddInt64(&counter.retries, 1)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// Delay returns the delay before retrying after the given attempt, a random
+// duration between zero and the exponential backoff capped to MaxDelay.
+func (policy Policy) Delay(attempt int) time.Duration {
+	backoff := policy.BaseDelay
+	for i := 1; i < attempt && backoff < policy.MaxDelay; i++ {
+		backoff *= 2
+	}
+	if policy.MaxDelay > 0 && backoff > policy.MaxDelay {
+		backoff = policy.MaxDelay
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	jitterRandMutex.Lock()
+	defer jitterRandMutex.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(backoff) + 1))
+}
@@ -0,0 +1,84 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errRetryable = errors.New("retryable")
+
+func isRetryable(err error) bool {
+	return err == errRetryable
+}
+
+func TestDo(t *testing.T) {
+	policy := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond}
+	errFatal := errors.New("fatal")
+	testCases := []struct {
+		name             string
+		errs             []error
+		expectedErr      error
+		expectedAttempts int
+	}{
+		{name: "success", errs: []error{nil}, expectedAttempts: 1},
+		{name: "retried success", errs: []error{errRetryable, errRetryable, nil}, expectedAttempts: 3},
+		{name: "exhausted", errs: []error{errRetryable, errRetryable, errRetryable, nil}, expectedErr: errRetryable, expectedAttempts: 3},
+		{name: "not retryable", errs: []error{errFatal, nil}, expectedErr: errFatal, expectedAttempts: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx, counter := WithCounter(context.Background())
+			attempts := 0
+			err := policy.Do(ctx, "test", isRetryable, func() error {
+				attempts++
+				return tc.errs[attempts-1]
+			})
+			assert.Equal(tc.expectedErr, err)
+			assert.Equal(tc.expectedAttempts, attempts)
+			assert.Equal(tc.expectedAttempts-1, counter.Retries())
+		})
+	}
+}
+
+func TestDoStopsWhenContextIsDone(t *testing.T) {
+	assert := assert.New(t)
+	policy := Policy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	attempts := 0
+	err := policy.Do(ctx, "test", isRetryable, func() error {
+		attempts++
+		return errRetryable
+	})
+	assert.Equal(errRetryable, err)
+	assert.Equal(1, attempts)
+}
+
+func TestZeroPolicyMakesASingleAttempt(t *testing.T) {
+	attempts := 0
+	err := Policy{}.Do(context.Background(), "test", isRetryable, func() error {
+		attempts++
+		return errRetryable
+	})
+	assert.Equal(t, errRetryable, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestDelay(t *testing.T) {
+	assert := assert.New(t)
+	policy := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for i := 0; i < 100; i++ {
+		assert.True(policy.Delay(1) <= 100*time.Millisecond)
+		assert.True(policy.Delay(3) <= 400*time.Millisecond)
+		assert.True(policy.Delay(50) <= time.Second)
+		assert.True(policy.Delay(50) >= 0)
+	}
+	assert.Equal(time.Duration(0), Policy{}.Delay(3))
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sensu-community/sensu-plugin-sdk/httpclient"
+	corev2 "github.com/sensu/sensu-go/api/core/v2"
+)
+
+const (
+	// listPageSize is the number of resources requested per page when listing
+	listPageSize = 500
+
+	// deregistrationEventCheck is the check name of the deregistration events
+	deregistrationEventCheck = "ec2-deregistration"
+
+	// stateReasonCodeAnnotation and stateReasonCategoryAnnotation are the
+	// annotations of the deregistration events recording the state reason
+	// of the instance
+	stateReasonCodeAnnotation     = "sensu.io/plugins/sensu-ec2-handler/state-reason-code"
+	stateReasonCategoryAnnotation = "sensu.io/plugins/sensu-ec2-handler/state-reason-category"
+)
+
+// newSensuClient creates a client for the Sensu API using the configured URL,
+// API key, CA certificates and client certificate.
+func newSensuClient() (*httpclient.CoreClient, error) {
+	client := httpclient.NewCoreClient(httpclient.CoreClientConfig{
+		URL:    sensuAPIURL,
+		APIKey: sensuAPIKey,
+	})
+	if len(sensuCACert) == 0 && len(sensuClientCert) == 0 {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if len(sensuCACert) > 0 {
+		caCerts, err := loadCACertificates(sensuCACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs, err = x509.SystemCertPool()
+		if err != nil {
+			log.Printf("Unable to load the system certificate pool: %s\n", err)
+			tlsConfig.RootCAs = x509.NewCertPool()
+		}
+		for _, caCert := range caCerts {
+			tlsConfig.RootCAs.AddCert(caCert)
+		}
+	}
+	if len(sensuClientCert) > 0 {
+		clientCert, err := loadClientCertificate(sensuClientCert, sensuClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+	client.HTTPClient.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+
+	return client, nil
+}
+
+// loadCACertificates loads the CA certificates from a PEM file with one or
+// more certificates, a DER file, or inline PEM content.
+func loadCACertificates(value string) ([]*x509.Certificate, error) {
+	data, err := readPEMOrFile(value)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load sensu-ca-cert: %s", err)
+	}
+
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		certs, err := x509.ParseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sensu-ca-cert: %s", err)
+		}
+		return certs, nil
+	}
+
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sensu-ca-cert: %s", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("invalid sensu-ca-cert: no PEM certificate found")
+	}
+	return certs, nil
+}
+
+// loadClientCertificate loads the client certificate and key used for mutual
+// TLS, each from a PEM file or inline PEM content.
+func loadClientCertificate(certValue, keyValue string) (tls.Certificate, error) {
+	certPEM, err := readPEMOrFile(certValue)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("unable to load sensu-client-cert: %s", err)
+	}
+	keyPEM, err := readPEMOrFile(keyValue)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("unable to load sensu-client-key: %s", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid sensu-client-cert or sensu-client-key: %s", err)
+	}
+	return cert, nil
+}
+
+// readPEMOrFile returns the value itself if it is inline PEM content,
+// otherwise the content of the file it names.
+func readPEMOrFile(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// deleteEntity deletes the entity from Sensu. An entity that no longer exists
+// is not considered an error, false is then returned.
+func deleteEntity(ctx context.Context, client *httpclient.CoreClient, entity *corev2.Entity) (bool, error) {
+	request, err := httpclient.NewResourceRequest("core/v2", "Entity", entity.Namespace, entity.Name)
+	if err != nil {
+		return false, err
+	}
+
+	log.Printf("Deleting entity (%s/%s)", entity.Namespace, entity.Name)
+	err = sensuRetry(ctx, "Deleting entity", func() error {
+		_, err := client.DeleteResource(ctx, request)
+		return err
+	})
+	if err != nil {
+		if httperr, ok := err.(httpclient.HTTPError); ok && httperr.StatusCode == http.StatusNotFound {
+			log.Printf("entity already deleted (%s/%s)", entity.Namespace, entity.Name)
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// putEntity creates or replaces the entity in Sensu.
+func putEntity(ctx context.Context, client *httpclient.CoreClient, entity *corev2.Entity) error {
+	request, err := httpclient.NewResourceRequest("core/v2", "Entity", entity.Namespace, entity.Name)
+	if err != nil {
+		return err
+	}
+	request.Resource = entity
+
+	log.Printf("Restoring entity (%s/%s)", entity.Namespace, entity.Name)
+	return sensuRetry(ctx, "Restoring entity", func() error {
+		_, err := client.PutResource(ctx, request)
+		return err
+	})
+}
+
+// getEntity gets the entity from Sensu, nil is returned if it no longer exists.
+func getEntity(ctx context.Context, client *httpclient.CoreClient, namespace, name string) (*corev2.Entity, error) {
+	request, err := httpclient.NewResourceRequest("core/v2", "Entity", namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	entity := request.Resource.(*corev2.Entity)
+	found, err := getResource(ctx, client, "Getting entity", request, entity)
+	if err != nil || !found {
+		return nil, err
+	}
+	return entity, nil
+}
+
+// getEvent gets the event of the check of the entity from Sensu, nil is
+// returned if it does not exist.
+func getEvent(ctx context.Context, client *httpclient.CoreClient, namespace, entityName, checkName string) (*corev2.Event, error) {
+	request := httpclient.NewEventRequest(namespace, entityName, checkName)
+	event := request.Resource.(*corev2.Event)
+	found, err := getResource(ctx, client, "Getting event", request, event)
+	if err != nil || !found {
+		return nil, err
+	}
+	return event, nil
+}
+
+// getResource gets the resource of the request from Sensu into result, false
+// is returned if it does not exist.
+func getResource(ctx context.Context, client *httpclient.CoreClient, operation string, request httpclient.ResourceRequest, result corev2.Resource) (bool, error) {
+	err := sensuRetry(ctx, operation, func() error {
+		_, err := client.GetResource(ctx, request, result)
+		return err
+	})
+	if httperr, ok := err.(httpclient.HTTPError); ok && httperr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// deleteEvent deletes the event of the check of the entity from Sensu. An
+// event that no longer exists is not considered an error.
+func deleteEvent(ctx context.Context, client *httpclient.CoreClient, entity *corev2.Entity, checkName string) error {
+	request := httpclient.NewEventRequest(entity.Namespace, entity.Name, checkName)
+
+	log.Printf("Deleting event (%s/%s/%s)", entity.Namespace, entity.Name, checkName)
+	err := sensuRetry(ctx, "Deleting event", func() error {
+		_, err := client.DeleteResource(ctx, request)
+		return err
+	})
+	if httperr, ok := err.(httpclient.HTTPError); ok && httperr.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// silenceEntity creates a silenced entry for all the checks of the entity,
+// with the configured expiry. An existing entry is left as is, so that the
+// failing keepalives of a stopped instance do not keep resetting its expiry,
+// and false is returned.
+func silenceEntity(ctx context.Context, client *httpclient.CoreClient, entity *corev2.Entity, reason string) (bool, error) {
+	silenced := &corev2.Silenced{
+		ObjectMeta:   corev2.NewObjectMeta("", entity.Namespace),
+		Subscription: corev2.GetEntitySubscription(entity.Name),
+		Expire:       -1,
+		Creator:      awsConfig.PluginConfig.Name,
+		Reason:       reason,
+	}
+	if silenceExpireDuration > 0 {
+		silenced.Expire = int64(silenceExpireDuration.Seconds())
+	}
+	name, err := corev2.SilencedName(silenced.Subscription, silenced.Check)
+	if err != nil {
+		return false, err
+	}
+	silenced.Name = name
+
+	request := httpclient.ResourceRequest{
+		TypeMeta: corev2.TypeMeta{
+			APIVersion: "core/v2",
+			Type:       "Silenced",
+		},
+		ObjectMeta: silenced.ObjectMeta,
+		Resource:   silenced,
+	}
+
+	exists, err := getResource(ctx, client, "Getting silenced entry", request, &corev2.Silenced{})
+	if err != nil {
+		return false, fmt.Errorf("could not get silenced entry %s: %s", name, err)
+	}
+	if exists {
+		log.Printf("Entity already silenced (%s/%s)", entity.Namespace, entity.Name)
+		return false, nil
+	}
+
+	log.Printf("Silencing entity (%s/%s)", entity.Namespace, entity.Name)
+	err = sensuRetry(ctx, "Silencing entity", func() error {
+		_, err := client.PutResource(ctx, request)
+		return err
+	})
+	return err == nil, err
+}
+
+// postDeregistrationEvent posts an event recording the action taken on the
+// entity against the configured deregistration event proxy entity.
+func postDeregistrationEvent(ctx context.Context, client *httpclient.CoreClient, entity *corev2.Entity, report *deregistrationReport) error {
+	verb := "Deleted"
+	if report.Action == actionSilence {
+		verb = "Silenced"
+	}
+	output := fmt.Sprintf("%s entity %s/%s, EC2 instance %s", verb, entity.Namespace, entity.Name, report.InstanceID)
+	if len(report.Region) > 0 {
+		output += fmt.Sprintf(" in %s", report.Region)
+	}
+	output += fmt.Sprintf(" is %s", report.InstanceState)
+	category := report.stateReasonCategory()
+	stateReasonCode := ""
+	if report.Instance != nil {
+		stateReasonCode = report.Instance.StateReasonCode
+	}
+	if len(stateReasonCode) > 0 {
+		output += fmt.Sprintf(", %s (%s)", category, stateReasonCode)
+	}
+	output += "\n"
+
+	request := newProxyEventRequest(entity.Namespace, deregistrationEventEntity, deregistrationEventCheck, output, deregistrationEventStatus)
+	event := request.Resource.(*corev2.Event)
+	event.Check.Annotations = map[string]string{
+		stateReasonCodeAnnotation:     stateReasonCode,
+		stateReasonCategoryAnnotation: category,
+	}
+	for key, value := range deregistrationEventReasonAnnotationsMap[category] {
+		event.Check.Annotations[key] = value
+	}
+	log.Printf("Posting deregistration event (%s/%s/%s)", entity.Namespace, deregistrationEventEntity, deregistrationEventCheck)
+	if err := postEvent(ctx, client, "Posting deregistration event", request); err != nil {
+		return fmt.Errorf("could not post deregistration event: %s", err)
+	}
+	return nil
+}
+
+// postsDeregistrationEvent returns true if a deregistration event is posted for
+// the report, when the event is enabled for the state reason category of its
+// instance. No event is posted when the action left the entity unchanged, so
+// that the failing keepalives of a silenced entity do not notify again.
+func postsDeregistrationEvent(report *deregistrationReport) bool {
+	if len(deregistrationEventEntity) == 0 || len(report.Unchanged) > 0 {
+		return false
+	}
+	return len(deregistrationEventReasonsList) == 0 || containsString(deregistrationEventReasonsList, report.stateReasonCategory())
+}
+
+// newProxyEventRequest creates the request posting an event of the check
+// against the proxy entity, handled by the deregistration event handlers.
+func newProxyEventRequest(namespace, entityName, checkName, output string, status int) httpclient.ResourceRequest {
+	now := time.Now().Unix()
+	request := httpclient.NewEventRequest(namespace, entityName, checkName)
+	event := request.Resource.(*corev2.Event)
+	event.ObjectMeta = corev2.NewObjectMeta("", namespace)
+	event.Entity.ObjectMeta = corev2.NewObjectMeta(entityName, namespace)
+	event.Check.ObjectMeta = corev2.NewObjectMeta(checkName, namespace)
+	event.Timestamp = now
+	event.Entity.EntityClass = corev2.EntityProxyClass
+	event.Check.Output = output
+	event.Check.Status = uint32(status)
+	event.Check.Handlers = deregistrationEventHandlersList
+	event.Check.Executed = now
+	event.Check.Issued = now
+	return request
+}
+
+// postEvent posts the event request to the Sensu API.
+func postEvent(ctx context.Context, client *httpclient.CoreClient, operation string, request httpclient.ResourceRequest) error {
+	return sensuRetry(ctx, operation, func() error {
+		_, err := client.PostResource(ctx, request)
+		return err
+	})
+}
+
+// listEntities lists all the entities of the namespace, following the Sensu
+// API pagination.
+func listEntities(ctx context.Context, client *httpclient.CoreClient, namespace string) ([]*corev2.Entity, error) {
+	uriPath := path.Join(corev2.URLPrefix, "namespaces", url.PathEscape(namespace), corev2.EntitiesResource)
+
+	entities := []*corev2.Entity{}
+	continueToken := ""
+	for {
+		var page []*corev2.Entity
+		var nextToken string
+		err := sensuRetry(ctx, "Listing entities", func() (err error) {
+			page = []*corev2.Entity{}
+			nextToken, err = listResources(ctx, client, uriPath, continueToken, &page)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing entities in namespace %s: %s", namespace, err)
+		}
+		entities = append(entities, page...)
+		continueToken = nextToken
+		if len(continueToken) == 0 {
+			return entities, nil
+		}
+	}
+}
+
+// listEntityEvents lists all the events of the entity, following the Sensu API
+// pagination.
+func listEntityEvents(ctx context.Context, client *httpclient.CoreClient, entity *corev2.Entity) ([]*corev2.Event, error) {
+	uriPath := path.Join(corev2.URLPrefix, "namespaces", url.PathEscape(entity.Namespace), corev2.EventsResource, url.PathEscape(entity.Name))
+
+	events := []*corev2.Event{}
+	continueToken := ""
+	for {
+		var page []*corev2.Event
+		var nextToken string
+		err := sensuRetry(ctx, "Listing events", func() (err error) {
+			page = []*corev2.Event{}
+			nextToken, err = listResources(ctx, client, uriPath, continueToken, &page)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing events of entity %s/%s: %s", entity.Namespace, entity.Name, err)
+		}
+		events = append(events, page...)
+		continueToken = nextToken
+		if len(continueToken) == 0 {
+			return events, nil
+		}
+	}
+}
+
+// listResources gets a single page of resources from the Sensu API and decodes
+// it into result. The continue token of the next page is returned, it is empty
+// when there are no more pages.
+func listResources(ctx context.Context, client *httpclient.CoreClient, uriPath string, continueToken string, result interface{}) (string, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(listPageSize))
+	if len(continueToken) > 0 {
+		query.Set("continue", continueToken)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Config.URL+uriPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("error building request: %s", err)
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("Key %s", client.Config.APIKey))
+	request.Header.Set("Accept", "application/json")
+
+	response, err := client.HTTPClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 400 {
+		body, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<16))
+		if err != nil {
+			return "", err
+		}
+		return "", httpclient.HTTPError{
+			StatusCode: response.StatusCode,
+			Body:       string(body),
+		}
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return "", fmt.Errorf("error unmarshalling json: %s", err)
+	}
+
+	return response.Header.Get("Sensu-Continue"), nil
+}
+
+// sensuRetry calls the Sensu API operation with the retry policy.
+func sensuRetry(ctx context.Context, operation string, fn func() error) error {
+	return awsConfig.RetryPolicy.Do(ctx, operation, isRetryableSensuError, fn)
+}
+
+// isRetryableSensuError returns true for rate limiting errors, server errors
+// and network errors of the Sensu API.
+func isRetryableSensuError(err error) bool {
+	if httperr, ok := err.(httpclient.HTTPError); ok {
+		return httperr.StatusCode == http.StatusTooManyRequests || httperr.StatusCode >= 500
+	}
+	_, ok := err.(*url.Error)
+	return ok
+}